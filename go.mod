@@ -9,4 +9,5 @@ require (
 	github.com/meinside/kakao-api-go v0.2.6
 	github.com/meinside/loggly-go v0.1.8
 	github.com/meinside/telegram-bot-go v0.4.1
+	golang.org/x/image v0.0.0-20180708004352-c73c2afc3b81
 )
@@ -1,28 +1,55 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"image"
 	"image/color"
+	"image/color/palette"
 	"image/draw"
+	"image/gif"
 	"image/jpeg"
+	_ "image/png"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	mathrand "math/rand"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/template"
+	"time"
+	"unicode/utf8"
 
 	// for using .ttf
 	"github.com/disintegration/gift"
 	"github.com/golang/freetype"
 	"github.com/golang/freetype/truetype"
 	"github.com/llgcode/draw2d/draw2dimg"
+	xfont "golang.org/x/image/font"
+
+	// for decoding more image formats
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 
 	// kakao rest api
 	kakaoapi "github.com/meinside/kakao-api-go"
@@ -35,10 +62,33 @@ import (
 )
 
 var client *bot.Bot
-var logger *loggly.Loggly
+
+// logs to be sent to Loggly in batches
+var logglyLogs chan logglyLog
+var logglyBulkURL string
+var logglyHTTPClient = &http.Client{Timeout: logglyTimeoutSeconds * time.Second}
+
+// for calling bot api methods which are not supported by the bot library (eg. setMessageReaction)
+var botAPIHTTPClient = &http.Client{Timeout: botAPITimeoutSeconds * time.Second}
+
+// for posting results to the webhook
+var resultWebhookHTTPClient = &http.Client{Timeout: resultWebhookTimeoutSeconds * time.Second}
 
 const (
 	appName = "KakaoVisionBot"
+
+	logglyBulkURLFormat        = "https://logs-01.loggly.com/bulk/%s/tag/bulk/"
+	numQueuedLogglyLogs        = 128
+	logglyBatchSize            = 32
+	logglyFlushIntervalSeconds = 5
+	logglyTimeoutSeconds       = 10
+
+	resultWebhookTimeoutSeconds = 10
+
+	botAPIBaseURL        = "https://api.telegram.org"
+	botAPITimeoutSeconds = 10
+
+	PollingBackoffMaxSeconds = 60 // max polling interval on consecutive errors
 )
 
 // logglyLog struct
@@ -61,9 +111,29 @@ const (
 	Tag            VisionCommand = "Tag This Image"
 	AnalyzePoses   VisionCommand = "Analyze Poses"
 	ExtractTexts   VisionCommand = "Extract Texts"
+	CountProducts  VisionCommand = "Count Products"
+	CountFaces     VisionCommand = "Count Faces"
+	ProductSummary VisionCommand = "Product Summary"
+	PoseSilhouette VisionCommand = "Pose Silhouette"
+	DetectAll      VisionCommand = "Detect All"
+	ReportCard     VisionCommand = "Report Card"
+	CropFaces      VisionCommand = "Crop Faces"
+	FaceSheet      VisionCommand = "Face Sheet"
+	CropProducts   VisionCommand = "Crop Products"
+	AnalyzeColors  VisionCommand = "Analyze Colors"
+
+	DetectAndMaskFaces VisionCommand = "Detect & Mask Faces"
+	DetectionHeatmap   VisionCommand = "Detection Heatmap"
+
+	// admin-only commands
+	CompareThresholds VisionCommand = "Compare Thresholds"
+	DebugGrid         VisionCommand = "Debug Grid"
+	NSFWHeatmap       VisionCommand = "NSFW Heatmap"
 
 	// fun commands
-	MaskFaces VisionCommand = "Mask Faces"
+	MaskFaces      VisionCommand = "Mask Faces"
+	EmojiFaces     VisionCommand = "Emoji Faces"
+	BlurBackground VisionCommand = "Blur Background"
 
 	None VisionCommand = ""
 )
@@ -76,14 +146,110 @@ var allCmds = map[VisionCommand]string{
 	Tag:            "tag",
 	AnalyzePoses:   "analyze_poses",
 	ExtractTexts:   "extract_texts",
+	CountProducts:  "count_products",
+	CountFaces:     "count_faces",
+	ProductSummary: "product_summary",
+	PoseSilhouette: "pose_silhouette",
+	DetectAll:      "detect_all",
+	ReportCard:     "report_card",
+	CropFaces:      "crop_faces",
+	FaceSheet:      "face_sheet",
+	CropProducts:   "crop_products",
+	AnalyzeColors:  "analyze_colors",
+
+	DetectAndMaskFaces: "detect_and_mask_faces",
+	DetectionHeatmap:   "detection_heatmap",
+
+	// admin-only commands
+	CompareThresholds: "compare_thresholds",
+	DebugGrid:         "debug_grid",
+	NSFWHeatmap:       "nsfw_heatmap",
 
 	// fun commands
-	MaskFaces: "mask_faces",
+	MaskFaces:      "mask_faces",
+	EmojiFaces:     "emoji_faces",
+	BlurBackground: "blur_background",
+}
+
+// localized names of commands (key: language code)
+//
+// (english command constants are used when missing)
+var localizedCmds = map[string]map[VisionCommand]string{
+	"ko": {
+		DetectFaces:    "얼굴 감지",
+		DetectProducts: "상품 감지",
+		DetectNSFW:     "성인 이미지 판별",
+		Tag:            "태그 달기",
+		AnalyzePoses:   "자세 분석",
+		ExtractTexts:   "텍스트 추출",
+		CountProducts:  "상품 세기",
+		CountFaces:     "얼굴 세기",
+		ProductSummary: "상품 요약",
+		PoseSilhouette: "자세 실루엣",
+		DetectAll:      "모두 감지",
+		ReportCard:     "종합 리포트",
+		CropFaces:      "얼굴 잘라내기",
+		FaceSheet:      "얼굴 모아보기",
+		CropProducts:   "상품 잘라내기",
+		AnalyzeColors:  "색상 분석",
+
+		DetectAndMaskFaces: "얼굴 감지 & 가리기",
+		DetectionHeatmap:   "감지 히트맵",
+
+		CompareThresholds: "임계값 비교",
+		DebugGrid:         "디버그 격자",
+		NSFWHeatmap:       "성인 이미지 영역",
+
+		MaskFaces:      "얼굴 가리기",
+		EmojiFaces:     "얼굴 이모지",
+		BlurBackground: "배경 흐리기",
+	},
+}
+
+// localized formats of result titles (key: language code)
+var localizedResultTitles = map[string]struct {
+	title, forwarded string
+}{
+	"ko": {
+		title:     "'%s' 처리 결과",
+		forwarded: "'%s' 처리 결과 (%s에서 전달됨)",
+	},
+}
+
+// commands which are allowed only in `admin-chat-ids` (eg. ones consuming more api quota)
+var adminCmds = map[VisionCommand]bool{
+	CompareThresholds: true,
+	DebugGrid:         true,
+	NSFWHeatmap:       true,
+}
+
+// thresholds of face detection for Compare Thresholds
+var compareThresholds = []float32{0.3, 0.5, 0.7, 0.9}
+
+// aliases of commands (key: alias, value: command), extended with `command-aliases`
+var cmdAliases = map[string]string{
+	"faces":    "detect_faces",
+	"products": "detect_products",
+	"nsfw":     "detect_nsfw",
+	"tags":     "tag",
+	"poses":    "analyze_poses",
+	"ocr":      "extract_texts",
+	"texts":    "extract_texts",
+	"all":      "detect_all",
+	"heatmap":  "detection_heatmap",
+	"mask":     "mask_faces",
+	"emoji":    "emoji_faces",
+	"blur":     "blur_background",
 }
 
 func visionCommandForCommand(cmd string) (result VisionCommand) {
 	result = None
 
+	cmd = strings.ToLower(strings.TrimSpace(cmd))
+	if aliased, exists := cmdAliases[cmd]; exists {
+		cmd = aliased
+	}
+
 	for k, v := range allCmds {
 		if v == cmd {
 			result = k
@@ -96,17 +262,105 @@ func visionCommandForCommand(cmd string) (result VisionCommand) {
 }
 
 var fileIDs = map[string]string{}
+var fileIDsLock sync.RWMutex
+
+// jobs of image processing, consumed by a fixed number of workers
+type imageJob struct {
+	correlationID     string
+	username          string
+	chatID            int64
+	messageIDToDelete int64
+	fileID            string
+	fileURL           string
+	command           VisionCommand
+	forwardedFrom     string // attribution of the forwarded image (if any)
+	maskStyle         string // masking style of Mask Faces (empty: pixelate)
+	replyToMessageID  int64  // id of the original image message (results will be sent as replies to it)
+	languageCode      string // language of the requester (for localized captions)
+	queuePosition     int    // position in the queue when enqueued (0: processed immediately)
+}
+
+var imageJobs chan imageJob
+var busyWorkers int32 // number of workers processing jobs now (atomic)
+
+var verbose int32 // 1 if verbose logging is on (atomic, as it can be toggled with `/verbose` at runtime)
+
+// attributions of forwarded images (key: file id)
+var fileAttributions = map[string]string{}
+var fileAttributionsLock sync.RWMutex
+
+// templates of result captions (key: command)
+var captionTemplates = map[VisionCommand]*template.Template{}
+
+// per-chat settings (persisted in a file)
+type chatSettings struct {
+	DefaultCommand VisionCommand `json:"default_command,omitempty"`
+	LastFileID     string        `json:"last_file_id,omitempty"`
+	Colors         []string      `json:"colors,omitempty"` // custom palette of annotations (hex, eg. #FF0000)
+	LastCommand    VisionCommand `json:"last_command,omitempty"`
 
-var kakaoClient *kakaoapi.Client
+	// for limiting daily requests
+	RequestsDate  string `json:"requests_date,omitempty"` // yyyy-mm-dd
+	RequestsCount int    `json:"requests_count,omitempty"`
+}
+
+var chats = map[int64]chatSettings{}
+var chatsLock sync.RWMutex
+var chatsFilepath string
+
+// kakao api clients (one per api key, used in round-robin manner)
+var kakaoClients []*kakaoapi.Client
+var kakaoClientsIndex int
+var kakaoClientsLock sync.Mutex
 
 var font *truetype.Font
 
+// username of this bot (for the default watermark text)
+var botUsername string
+
+// default emoji image for overlaying on faces
+//
+//go:embed images/emoji.png
+var defaultEmojiBytes []byte
+
+var emoji image.Image
+
+// color of label texts (nil: same as their boxes)
+var labelTextColor color.Color
+
+// sample image for `/selftest`
+//
+//go:embed images/selftest.jpg
+var selfTestImageBytes []byte
+
 const (
-	messageActionImage     = "Choose action for this image:"
-	messageUnprocessable   = "Unprocessable message."
-	messageFailedToGetFile = "Failed to get file from the server."
-	messageCanceled        = "Canceled."
-	messageHelp            = `Send any image to this bot, then select one of the following actions:
+	messageActionImage       = "Choose action for this image:"
+	messageUnprocessable     = "Unprocessable message."
+	messageFailedToGetFile   = "Failed to get file from the server."
+	messageFileTooLarge      = "This image exceeds Telegram's download limit for bots (20MB), please send a smaller one."
+	messageCanceled          = "Canceled."
+	messageRetry             = "Retry"
+	messagePrevPage          = "◀ Prev"
+	messageNextPage          = "Next ▶"
+	messagePage              = "(page %d/%d)"
+	messagePageExpired       = "These pages are no longer available."
+	messagePDFFirstPageOnly  = "This PDF document has %d pages, but only the first page will be processed."
+	messageNoImageInPDF      = "No image is embedded on the first page of this PDF document. (text and drawings in PDF documents are not rendered, so only scanned documents can be processed)"
+	messageUnreadablePDF     = "Failed to read this PDF document: %s"
+	messageDailyLimitReached = "Daily limit of requests for this chat is reached, please try again tomorrow."
+	messageNotAllowed        = "This command is not allowed in this chat."
+	messageBusy              = "Too many images are being processed now, please try again later."
+	messageInvalidDataURI    = "Failed to read image from data URI: %s"
+	messageNotAnImage        = "This file doesn't look like an image (detected: %s), so it was not processed."
+	messageProcessing        = "Processing '%s' on received image..."
+	messageQueuePosition     = "(You are #%d in the queue)"
+	messageDone              = "Done: '%s' on received image."
+	messageLabelingPoll      = "What is product #%d?"
+	messageSomethingElse     = "Something else"
+	messageResultRouted      = "Result of '%s' was sent to another chat."
+	messageFailed            = "Failed: '%s' on received image."
+	messageChooseMaskStyle   = "Choose masking style for this image:"
+	messageHelp              = `Send any image to this bot, then select one of the following actions:
 
 - Detect Faces
 - Detect Products
@@ -114,14 +368,73 @@ const (
 - Tag This Image
 - Analyze Poses
 - Extract Texts
+- Count Products
+- Count Faces
+- Product Summary
+- Pose Silhouette
+- Detect All (faces and products)
+- Report Card (all detections in one image)
+- Crop Faces
+- Face Sheet (cropped faces in one image)
+- Crop Products
+- Analyze Colors
+- Detect & Mask Faces
+- Detection Heatmap (of faces and products)
 - Mask Faces
+- Emoji Faces
+- Blur Background
+
+(PDF documents of scanned pages are also accepted, and the scanned image on their first pages will be processed)
+(small images can also be sent as data URIs in text messages, eg. data:image/png;base64,...)
 
 then it will send the result message and/or image back to you.
 
+Commands:
+
+- /default [COMMAND|off]: process images with COMMAND (eg. detect_faces, or its alias faces) immediately, without selecting an action
+- /last: select an action for the last image again
+- /again: run the last command again on the last image
+- /cancel: cancel pending things (eg. default command) of this chat
+- /whoami: show ids of you and this chat (for configuring the bot)
+- /colors [#RRGGBB ...|off]: set colors of annotations for this chat (eg. /colors #FF0000 #00FF00)
+
 * Github: https://github.com/meinside/telegram-bot-kakao-vision
 `
 
 	commandCancel = "cancel"
+	commandRetry  = "retry" // prefix of callback data for retrying failed commands
+	commandPage   = "page"  // prefix of callback data for navigating pages of paginated texts
+
+	// text commands
+	textCommandDefault  = "default"
+	textCommandLast     = "last"
+	textCommandCancel   = "cancel"
+	textCommandWhoAmI   = "whoami"
+	textCommandColors   = "colors"
+	textCommandAgain    = "again"
+	textCommandSelfTest = "selftest" // admin-only
+	textCommandVerbose  = "verbose"  // admin-only
+	textParamOn         = "on"
+	textParamOff        = "off"
+
+	defaultChatsFilename = "chats.json"
+
+	defaultNumWorkers   = 4
+	defaultJobQueueSize = 32
+
+	defaultProductDetectionThreshold = 0.7
+
+	defaultWatermarkOpacity = 0.5
+
+	defaultKakaoTimeoutSeconds = 30
+
+	telegramMaxDownloadBytes = 20 * 1024 * 1024 // max size of files downloadable from the public bot api
+	defaultMaxDownloadBytes  = telegramMaxDownloadBytes
+
+	defaultMaxResultBytes = 10 * 1024 * 1024 // max size of photos uploadable to bot api
+
+	defaultNSFWTileSize        = 512 // in pixels
+	defaultNSFWTileConcurrency = 4
 
 	fontFilepath = "fonts/RobotoCondensed-Regular.ttf"
 )
@@ -131,10 +444,219 @@ const (
 	CircleRadius = 0.5
 	StrokeWidth  = 1.5
 
-	PosePointRadius = 2.0
-	PoseStrokeWidth = 1.5
+	PosePointRadius    = 2.0
+	PosePointRadiusMin = 1.0
+	PosePointRadiusMax = 4.0
+	PoseStrokeWidth    = 1.5
+
+	BadgePadding = 3
+
+	DefaultPixelateDivisor = 8 // face width / divisor = pixelation block size
+	MinPixelateBlockSize   = 4
+
+	DashLength = StrokeWidth * 4
+	DashGap    = StrokeWidth * 3
+
+	BoxCornerRadiusRatio = 0.1 // radius of rounded corners (ratio to the shorter side of the box)
+
+	CropPaddingRatio = 0.2 // padding around cropped regions (ratio to the region's width/height)
+
+	MaxMediaGroupSize = 10 // max number of media in a media group
+
+	MaskRevealMaxSize    = 480 // max width/height of mask reveal animation
+	MaskRevealFrames     = 8
+	MaskRevealFrameDelay = 15  // 100ths of a second
+	MaskRevealHoldDelay  = 100 // 100ths of a second
+
+	BackgroundBlurSigmaRatio = 0.01 // sigma of gaussian blur = larger side of image * ratio
+	BackgroundBlurSigmaMin   = 2.0
+
+	ReportCardThumbnailSize = 480 // max width/height of the image in report cards
+	ReportCardPanelWidth    = 360
+	ReportCardFontSize      = 18
+	ReportCardPadding       = 16
+	ReportCardMaxTags       = 5
+
+	FaceSheetTileSize    = 160 // max width/height of each face in face sheets
+	FaceSheetMaxColumns  = 5
+	FaceSheetFontSize    = 16
+	FaceSheetLabelHeight = 28
+	FaceSheetPadding     = 8
+
+	RecompressionQualities  = 4 // number of steps lowering jpeg quality before downscaling
+	RecompressionMinQuality = 30
+	RecompressionScale      = 0.75 // ratio of downscaling per step
+	RecompressionMaxSteps   = 8
+
+	DebugGridDivisions = 10 // grid lines at every 10% of width/height
+
+	HeatmapScaleSize  = 128  // max width/height of the accumulation buffer of heatmap
+	HeatmapDotRadius  = 2    // radius of a dot stamped on the accumulation buffer (in its pixels)
+	HeatmapIncrement  = 4096 // value added to the accumulation buffer (16 bits) per dot
+	HeatmapSigmaRatio = 0.05 // sigma of gaussian blur = HeatmapScaleSize * ratio
+	HeatmapMinDensity = 0.05 // (normalized) densities lower than this are not drawn
+	HeatmapMaxAlpha   = 0.6
+
+	MaxNSFWTiles          = 36  // tiles are enlarged when there would be more tiles than this (for not exhausting api quota)
+	NSFWTileFlagThreshold = 0.5 // tiles which are not normal more than this are flagged
+
+	DominantColorsCount     = 5
+	DominantColorsScaleSize = 128 // max width/height of image for analyzing colors
+	ColorSwatchSize         = 80
+
+	PendingStepTTLSeconds = 300 // abandoned steps of multi-step commands are cleaned up after this
+
+	ProgressSpinnerIntervalSeconds = 2 // not too frequent, for not hitting rate limits of editing messages
+
+	MaxDataURIImageBytes = 5 * 1024 * 1024 // max size of an image received as a data URI
+	MaxStoredImages      = 32              // max number of images (received as data URIs) kept in memory
+
+	MaxLabelingPollsPerImage = 3   // max number of labeling polls sent for an image
+	MaxLabelingPolls         = 100 // max number of labeling polls kept in memory for logging their results
+	MaxLabelingPollOptions   = 4   // detected class and alternatives (excluding 'something else')
+
+	MaxFloodControlRetries = 3  // max number of retrying a request rejected by telegram's flood control
+	MaxRetryAfterSeconds   = 60 // longer `retry_after`s are not waited for (workers would be blocked too long)
+
+	TextPageLength    = 3000 // max number of characters in a page of paginated texts (telegram's limit is 4096)
+	MaxPaginatedTexts = 100  // max number of paginated texts kept in memory for navigating their pages
+
+	MaxPendingKakaoCalls = 64 // max number of kakao api calls running at once (including ones which already timed out)
+)
+
+// label styles
+const (
+	labelStyleInside = "inside" // draw label text inside the box (default)
+	labelStyleBadge  = "badge"  // draw index number as a filled badge at a corner of the box
+)
+
+// badge corners
+const (
+	badgeCornerTopLeft     = "top-left" // default
+	badgeCornerTopRight    = "top-right"
+	badgeCornerBottomLeft  = "bottom-left"
+	badgeCornerBottomRight = "bottom-right"
+)
+
+// masking styles of Mask Faces
+const (
+	maskStylePixelate = "pixelate" // default
+	maskStyleBlur     = "blur"
+	maskStyleBlackbox = "blackbox"
+)
+
+// masking styles in the order of buttons
+var maskStyles = []string{maskStylePixelate, maskStyleBlur, maskStyleBlackbox}
+
+// resolutions of result images
+const (
+	resultResolutionOriginal = "original" // default
+	resultResolutionLarge    = "large"
+	resultResolutionMedium   = "medium"
+)
+
+// max width/height of result images per resolution
+var resultResolutionSizes = map[string]int{
+	resultResolutionLarge:  1280,
+	resultResolutionMedium: 800,
+}
+
+// box corner styles
+const (
+	boxCornerSharp   = "sharp" // default
+	boxCornerRounded = "rounded"
+)
+
+// torso styles of poses
+const (
+	poseTorsoCross = "cross" // connect shoulders and hips crosswise (default)
+	poseTorsoSpine = "spine" // connect the nose, the midpoint of shoulders, and the midpoint of hips
+)
+
+// chat type of supergroups (not declared in telegram-bot-go)
+const chatTypeSupergroup bot.ChatType = "supergroup"
+
+// triggers of the bot in group chats
+const (
+	groupTriggerMentionOrReply = "mention-or-reply" // when mentioned, or replied to (default)
+	groupTriggerMention        = "mention"          // only when mentioned
+	groupTriggerReply          = "reply"            // only when replied to
+	groupTriggerAll            = "all"              // on every image, like in private chats
+)
+
+// pose coloring styles
+const (
+	poseColoringPerson   = "person"    // color all parts of a pose with one color (default)
+	poseColoringBodyPart = "body-part" // color parts of a pose by body part groups
+)
+
+// body part groups of a pose
+type bodyPart int
+
+const (
+	bodyPartHead bodyPart = iota
+	bodyPartArms
+	bodyPartTorso
+	bodyPartLegs
 )
 
+// colors for body part groups
+var bodyPartColors = map[bodyPart]color.RGBA{
+	bodyPartHead:  {255, 255, 0, 255}, // yellow
+	bodyPartArms:  {0, 255, 255, 255}, // cyan
+	bodyPartTorso: {255, 0, 255, 255}, // purple
+	bodyPartLegs:  {0, 255, 0, 255},   // green
+}
+
+// keypoints of a pose
+var poseKeyPoints = []struct {
+	index kakaoapi.KeyPointIndex
+	part  bodyPart
+}{
+	{kakaoapi.KeyPointIndexNose, bodyPartHead},
+	{kakaoapi.KeyPointIndexLeftEye, bodyPartHead},
+	{kakaoapi.KeyPointIndexRightEye, bodyPartHead},
+	{kakaoapi.KeyPointIndexLeftEar, bodyPartHead},
+	{kakaoapi.KeyPointIndexRightEar, bodyPartHead},
+	{kakaoapi.KeyPointIndexLeftShoulder, bodyPartTorso},
+	{kakaoapi.KeyPointIndexRightShoulder, bodyPartTorso},
+	{kakaoapi.KeyPointIndexLeftElbow, bodyPartArms},
+	{kakaoapi.KeyPointIndexRightElbow, bodyPartArms},
+	{kakaoapi.KeyPointIndexLeftWrist, bodyPartArms},
+	{kakaoapi.KeyPointIndexRightWrist, bodyPartArms},
+	{kakaoapi.KeyPointIndexLeftHip, bodyPartTorso},
+	{kakaoapi.KeyPointIndexRightHip, bodyPartTorso},
+	{kakaoapi.KeyPointIndexLeftKnee, bodyPartLegs},
+	{kakaoapi.KeyPointIndexRightKnee, bodyPartLegs},
+	{kakaoapi.KeyPointIndexLeftAnkle, bodyPartLegs},
+	{kakaoapi.KeyPointIndexRightAnkle, bodyPartLegs},
+}
+
+// connections between keypoints of a pose
+var poseConnections = []struct {
+	from, to kakaoapi.KeyPointIndex
+	part     bodyPart
+}{
+	{kakaoapi.KeyPointIndexLeftShoulder, kakaoapi.KeyPointIndexRightShoulder, bodyPartTorso},
+	{kakaoapi.KeyPointIndexLeftShoulder, kakaoapi.KeyPointIndexLeftElbow, bodyPartArms},
+	{kakaoapi.KeyPointIndexRightShoulder, kakaoapi.KeyPointIndexRightElbow, bodyPartArms},
+	{kakaoapi.KeyPointIndexLeftElbow, kakaoapi.KeyPointIndexLeftWrist, bodyPartArms},
+	{kakaoapi.KeyPointIndexRightElbow, kakaoapi.KeyPointIndexRightWrist, bodyPartArms},
+	{kakaoapi.KeyPointIndexLeftHip, kakaoapi.KeyPointIndexRightHip, bodyPartTorso},
+	{kakaoapi.KeyPointIndexLeftHip, kakaoapi.KeyPointIndexLeftKnee, bodyPartLegs},
+	{kakaoapi.KeyPointIndexRightHip, kakaoapi.KeyPointIndexRightKnee, bodyPartLegs},
+	{kakaoapi.KeyPointIndexLeftKnee, kakaoapi.KeyPointIndexLeftAnkle, bodyPartLegs},
+	{kakaoapi.KeyPointIndexRightKnee, kakaoapi.KeyPointIndexRightAnkle, bodyPartLegs},
+}
+
+// cross connections between shoulders and hips (for "cross" torso style)
+var poseCrossConnections = []struct {
+	from, to kakaoapi.KeyPointIndex
+}{
+	{kakaoapi.KeyPointIndexLeftShoulder, kakaoapi.KeyPointIndexRightHip},
+	{kakaoapi.KeyPointIndexRightShoulder, kakaoapi.KeyPointIndexLeftHip},
+}
+
 // colors
 var colors = []color.RGBA{
 	{255, 255, 0, 255}, // yellow
@@ -146,18 +668,199 @@ var colors = []color.RGBA{
 }
 var maskColor = color.RGBA{0, 0, 0, 255} // black
 
+// colors of faces by gender
+var genderColors = map[string]color.RGBA{
+	"male":    {0, 128, 255, 255},   // blue
+	"female":  {255, 64, 160, 255},  // pink
+	"unknown": {160, 160, 160, 255}, // gray
+}
+
 // config file's name
 const (
 	configFilename = "config.json"
 )
 
+// environment variables' names (used when values are absent in the config file)
+const (
+	envTelegramAPIToken = "TELEGRAM_API_TOKEN"
+	envKakaoAPIKey      = "KAKAO_REST_API_KEY"
+	envLogglyToken      = "LOGGLY_TOKEN"
+)
+
 // Config struct
 type Config struct {
-	TelegramAPIToken               string `json:"telegram-api-token"`
-	TelegramMonitorIntervalSeconds int    `json:"telegram-monitor-interval-seconds"`
-	KakaoAPIKey                    string `json:"kakao-rest-api-key"`
-	LogglyToken                    string `json:"loggly-token,omitempty"`
-	IsVerbose                      bool   `json:"is-verbose"`
+	TelegramAPIToken               string   `json:"telegram-api-token"`
+	TelegramMonitorIntervalSeconds int      `json:"telegram-monitor-interval-seconds"`
+	KakaoAPIKey                    string   `json:"kakao-rest-api-key,omitempty"`
+	KakaoAPIKeys                   []string `json:"kakao-rest-api-keys,omitempty"` // rotated in round-robin manner
+	LogglyToken                    string   `json:"loggly-token,omitempty"`
+	IsVerbose                      bool     `json:"is-verbose"`
+
+	// send detected products as a caption-less image followed by a text report
+	SeparateProductReport bool `json:"separate-product-report,omitempty"`
+
+	// how labels of detected faces/products are drawn
+	LabelStyle  string `json:"label-style,omitempty"`  // "inside" (default) or "badge"
+	BadgeCorner string `json:"badge-corner,omitempty"` // "top-left" (default), "top-right", "bottom-left", or "bottom-right"
+
+	// corners of boxes drawn on detected faces and products
+	BoxCornerStyle string `json:"box-corner-style,omitempty"` // "sharp" (default) or "rounded"
+
+	// draw boxes with dashed lines (for distinguishing overlapping ones)
+	DashedLines bool `json:"dashed-lines,omitempty"`
+
+	// how poses are colored
+	PoseColoring string `json:"pose-coloring,omitempty"` // "person" (default) or "body-part"
+
+	// thickness of lines and radius of keypoint dots of poses (default: 1.5 and 2.0)
+	PoseStrokeWidth float64 `json:"pose-stroke-width,omitempty"`
+	PosePointRadius float64 `json:"pose-point-radius,omitempty"`
+
+	// how torsos of poses are drawn
+	PoseTorsoStyle string `json:"pose-torso-style,omitempty"` // "cross" (default) or "spine"
+
+	// draw only lines (without keypoint dots), or only keypoint dots (without lines) of poses
+	PoseSkeletonOnly bool `json:"pose-skeleton-only,omitempty"`
+	PoseDotsOnly     bool `json:"pose-dots-only,omitempty"`
+
+	// analyze poses on horizontally flipped images (for mirrored selfies from front cameras)
+	MirrorPoses bool `json:"mirror-poses,omitempty"`
+
+	// image file for overlaying on faces with Emoji Faces (default: embedded images/emoji.png)
+	EmojiFilepath string `json:"emoji-filepath,omitempty"`
+
+	// granularity of pixelation for Mask Faces (face width / divisor = block size or sigma of blur, default: 8)
+	PixelateDivisor int `json:"pixelate-divisor,omitempty"`
+
+	// send the result of Mask Faces as an animation (from the original image to the masked one)
+	MaskFacesAnimation bool `json:"mask-faces-animation,omitempty"`
+
+	// connect facial points (nose, eyes, and lips) into outlines
+	ConnectFacialPoints bool `json:"connect-facial-points,omitempty"`
+
+	// file for persisting per-chat settings (relative to the executable, default: chats.json)
+	ChatsFilepath string `json:"chats-filepath,omitempty"`
+
+	// also send coordinates of detected faces/products as a CSV document
+	SendDetectionsCSV bool `json:"send-detections-csv,omitempty"`
+
+	// url for posting results of each request as JSON (best-effort)
+	ResultWebhookURL string `json:"result-webhook-url,omitempty"`
+
+	// number of workers processing images concurrently (default: 4)
+	NumWorkers int `json:"num-workers,omitempty"`
+
+	// number of image processing jobs waiting for workers (busy when full, default: 32)
+	JobQueueSize int `json:"job-queue-size,omitempty"`
+
+	// base url of a self-hosted bot api server for downloading files (eg. "http://localhost:8081")
+	BotAPIBaseURL string `json:"bot-api-base-url,omitempty"`
+
+	// files directory of the self-hosted bot api server in `--local` mode (eg. "/var/lib/telegram-bot-api"),
+	// only in which files of absolute paths returned by the server are read
+	BotAPIFilesDir string `json:"bot-api-files-dir,omitempty"`
+
+	// threshold of kakao's product detection api request (default: 0.7)
+	//
+	// (not a filter of detected products for displaying, as the api returns no per-object scores)
+	ProductDetectionThreshold float32 `json:"product-detection-threshold,omitempty"`
+
+	// remove detected products overlapping with larger ones more than this IoU (0.0 ~ 1.0, default: 0 = disabled)
+	ProductNMSIoUThreshold float64 `json:"product-nms-iou-threshold,omitempty"`
+
+	// remove products overlapping with faces more than this IoU in Detect All (0.0 ~ 1.0, default: 0, disabled)
+	FaceProductIoUThreshold float64 `json:"face-product-iou-threshold,omitempty"`
+
+	// send multiple result images (eg. cropped faces/products) as a zip archive instead of media groups
+	ArchiveMultipleResults bool `json:"archive-multiple-results,omitempty"`
+
+	// templates of result captions (key: command, eg. "detect_faces", value: text/template)
+	CaptionTemplates map[string]string `json:"caption-templates,omitempty"`
+
+	// send text results (tags, texts, and nsfw factors) formatted with MarkdownV2
+	FormatTextResults bool `json:"format-text-results,omitempty"`
+
+	// max number of requests per chat in a day (persisted in `chats-filepath`, default: 0 = unlimited)
+	DailyRequestLimitPerChat int `json:"daily-request-limit-per-chat,omitempty"`
+
+	// send the result of Extract Texts as an image with numbered polygons drawn on texts (with a numbered list of them)
+	ExtractTextsAsImage bool `json:"extract-texts-as-image,omitempty"`
+
+	// keep detected texts in the order of api response (default: sorted in reading order)
+	OCRRawOrder bool `json:"ocr-raw-order,omitempty"`
+
+	// color faces by their genders (with a legend) instead of their indices
+	GenderColoring bool `json:"gender-coloring,omitempty"`
+
+	// ids of chats where admin-only commands (eg. Compare Thresholds) are allowed
+	AdminChatIDs []int64 `json:"admin-chat-ids,omitempty"`
+
+	// send the action keyboard again after processing, for running other commands on the same image
+	KeepKeyboard bool `json:"keep-keyboard,omitempty"`
+
+	// keep downloaded images in memory for this many seconds, for running multiple commands on them (default: 0, disabled)
+	DownloadCacheTTLSeconds int `json:"download-cache-ttl-seconds,omitempty"`
+
+	// max size of an image file to download (default: 20MB)
+	MaxDownloadBytes int64 `json:"max-download-bytes,omitempty"`
+
+	// draw a watermark text on annotated images
+	Watermark        bool    `json:"watermark,omitempty"`
+	WatermarkText    string  `json:"watermark-text,omitempty"`    // default: username of this bot
+	WatermarkCorner  string  `json:"watermark-corner,omitempty"`  // "top-left", "top-right", "bottom-left", or "bottom-right" (default)
+	WatermarkOpacity float64 `json:"watermark-opacity,omitempty"` // 0.0 ~ 1.0 (default: 0.5)
+
+	// animate the status message (eg. "Processing...") with cycling ellipses while processing
+	AnimateProgress bool `json:"animate-progress,omitempty"`
+
+	// timeout of each kakao api call (default: 30)
+	KakaoTimeoutSeconds int `json:"kakao-timeout-seconds,omitempty"`
+
+	// send the result image of Detect Faces/Products with its text report and detections (as CSV) in a zip document
+	ArchiveResults bool `json:"archive-results,omitempty"`
+
+	// react to original image messages with 👍 on success or 👎 on failure
+	ReactToResults bool `json:"react-to-results,omitempty"`
+
+	// resolution of result images: "original" (default), "large" (max 1280px), or "medium" (max 800px)
+	ResultResolution string `json:"result-resolution,omitempty"`
+
+	// edit the status message (eg. "Processing...") to a done state instead of deleting it
+	KeepStatusMessage bool `json:"keep-status-message,omitempty"`
+
+	// append pixel sizes, areas, and aspect ratios of boxes to labels of detected products
+	ProductLabelDimensions bool `json:"product-label-dimensions,omitempty"`
+
+	// send results of images from some chats to other chats (key: source chat id, value: destination chat id)
+	ResultChatRoutes map[string]int64 `json:"result-chat-routes,omitempty"`
+
+	// additional aliases of commands (key: alias, value: command, eg. {"crop": "crop_faces"})
+	CommandAliases map[string]string `json:"command-aliases,omitempty"`
+
+	// max size of encoded result images, recompressed with lower quality or downscaled when exceeded (default: 10MB)
+	MaxResultBytes int `json:"max-result-bytes,omitempty"`
+
+	// send polls asking what detected products are after Detect Products, for crowd labeling (results are logged)
+	LabelingPolls bool `json:"labeling-polls,omitempty"`
+
+	// skip detected faces whose width or height (relative to the image) is smaller than this fraction (0: keep all)
+	MinFaceFraction float64 `json:"min-face-fraction,omitempty"`
+
+	// color of label texts of detected faces/products (hex, eg. #FFFFFF), instead of their boxes' colors
+	LabelTextColor string `json:"label-text-color,omitempty"`
+
+	// size (in pixels) and number of concurrent api calls of tiles scored by NSFW Heatmap
+	NSFWTileSize        int `json:"nsfw-tile-size,omitempty"`
+	NSFWTileConcurrency int `json:"nsfw-tile-concurrency,omitempty"`
+
+	// when the bot acts on messages in group chats
+	GroupTrigger string `json:"group-trigger,omitempty"` // "mention-or-reply" (default), "mention", "reply", or "all"
+
+	// delete result messages after this many seconds, for privacy in shared chats (0: keep them)
+	ResultTTLSeconds int `json:"result-ttl-seconds,omitempty"`
+
+	// skip kakao api calls and just echo received images (for testing deployment)
+	DryRun bool `json:"dry-run,omitempty"`
 }
 
 var conf Config
@@ -170,7 +873,168 @@ func pwd() string {
 	return "." // fallback
 }
 
-func init() {
+// fill empty secrets of given config with values from environment variables
+//
+// (values in the config file take precedence over environment variables)
+func mergeEnvVars(conf Config, getenv func(string) string) Config {
+	if conf.TelegramAPIToken == "" {
+		conf.TelegramAPIToken = getenv(envTelegramAPIToken)
+	}
+	if conf.KakaoAPIKey == "" {
+		conf.KakaoAPIKey = getenv(envKakaoAPIKey)
+	}
+	if conf.LogglyToken == "" {
+		conf.LogglyToken = getenv(envLogglyToken)
+	}
+
+	return conf
+}
+
+// all kakao api keys from given config (without duplicates)
+func kakaoAPIKeys(conf Config) (keys []string) {
+	keys = []string{}
+
+	exists := map[string]bool{}
+	for _, key := range append([]string{conf.KakaoAPIKey}, conf.KakaoAPIKeys...) {
+		if key != "" && !exists[key] {
+			keys = append(keys, key)
+			exists[key] = true
+		}
+	}
+
+	return keys
+}
+
+// next kakao api client in the pool
+func nextKakaoClient() *kakaoapi.Client {
+	kakaoClientsLock.Lock()
+	defer kakaoClientsLock.Unlock()
+
+	if len(kakaoClients) <= 0 {
+		return nil
+	}
+
+	client := kakaoClients[kakaoClientsIndex%len(kakaoClients)]
+	kakaoClientsIndex = (kakaoClientsIndex + 1) % len(kakaoClients)
+
+	return client
+}
+
+// kakao api client which gives up waiting for responses after `kakao-timeout-seconds`
+//
+// (kakao api client doesn't accept a custom http client nor context, so calls are made in goroutines,
+// bounded by `MaxPendingKakaoCalls` as timed-out ones keep running until their requests end)
+type timedKakaoClient struct {
+	*kakaoapi.Client
+}
+
+// slots of running kakao api calls (a call holds its slot until it finishes, even after timing out)
+var kakaoCallSlots = make(chan struct{}, MaxPendingKakaoCalls)
+
+// run given kakao api call, and return an error if it doesn't finish in `kakao-timeout-seconds`
+//
+// (results of the call should not be read when it times out, as the call may still be running)
+func withKakaoTimeout(call func() error) error {
+	timeout := time.After(time.Duration(conf.KakaoTimeoutSeconds) * time.Second)
+
+	// wait for a free slot, for not piling up calls when the api is slow
+	select {
+	case kakaoCallSlots <- struct{}{}:
+	case <-timeout:
+		return fmt.Errorf("detection timed out after %d seconds, waiting for %d pending call(s)", conf.KakaoTimeoutSeconds, MaxPendingKakaoCalls)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() { <-kakaoCallSlots }()
+
+		done <- call()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timeout:
+		return fmt.Errorf("detection timed out after %d seconds", conf.KakaoTimeoutSeconds)
+	}
+}
+
+// DetectFaceFromBytes with timeout
+func (c timedKakaoClient) DetectFaceFromBytes(imgBytes []byte, threshold float32) (kakaoapi.ResponseDetectedFace, error) {
+	var result kakaoapi.ResponseDetectedFace
+	if err := withKakaoTimeout(func() (err error) {
+		result, err = c.Client.DetectFaceFromBytes(imgBytes, threshold)
+		return err
+	}); err != nil {
+		return kakaoapi.ResponseDetectedFace{}, err
+	}
+	return result, nil
+}
+
+// DetectProductFromBytes with timeout
+func (c timedKakaoClient) DetectProductFromBytes(imgBytes []byte, threshold float32) (kakaoapi.ResponseDetectedProduct, error) {
+	var result kakaoapi.ResponseDetectedProduct
+	if err := withKakaoTimeout(func() (err error) {
+		result, err = c.Client.DetectProductFromBytes(imgBytes, threshold)
+		return err
+	}); err != nil {
+		return kakaoapi.ResponseDetectedProduct{}, err
+	}
+	return result, nil
+}
+
+// DetectNSFWFromBytes with timeout
+func (c timedKakaoClient) DetectNSFWFromBytes(imgBytes []byte) (kakaoapi.ResponseDetectedNSFW, error) {
+	var result kakaoapi.ResponseDetectedNSFW
+	if err := withKakaoTimeout(func() (err error) {
+		result, err = c.Client.DetectNSFWFromBytes(imgBytes)
+		return err
+	}); err != nil {
+		return kakaoapi.ResponseDetectedNSFW{}, err
+	}
+	return result, nil
+}
+
+// GenerateTagsFromBytes with timeout
+func (c timedKakaoClient) GenerateTagsFromBytes(imgBytes []byte) (kakaoapi.ResponseGeneratedTags, error) {
+	var result kakaoapi.ResponseGeneratedTags
+	if err := withKakaoTimeout(func() (err error) {
+		result, err = c.Client.GenerateTagsFromBytes(imgBytes)
+		return err
+	}); err != nil {
+		return kakaoapi.ResponseGeneratedTags{}, err
+	}
+	return result, nil
+}
+
+// AnalyzePoseFromBytes with timeout
+func (c timedKakaoClient) AnalyzePoseFromBytes(imgBytes []byte) (kakaoapi.ResponseAnalyzedPose, error) {
+	var result kakaoapi.ResponseAnalyzedPose
+	if err := withKakaoTimeout(func() (err error) {
+		result, err = c.Client.AnalyzePoseFromBytes(imgBytes)
+		return err
+	}); err != nil {
+		return kakaoapi.ResponseAnalyzedPose{}, err
+	}
+	return result, nil
+}
+
+// DetectTextFromBytes with timeout
+func (c timedKakaoClient) DetectTextFromBytes(imgBytes []byte) (kakaoapi.ResponseDetectedText, error) {
+	var result kakaoapi.ResponseDetectedText
+	if err := withKakaoTimeout(func() (err error) {
+		result, err = c.Client.DetectTextFromBytes(imgBytes)
+		return err
+	}); err != nil {
+		return kakaoapi.ResponseDetectedText{}, err
+	}
+	return result, nil
+}
+
+// load config and set up clients, queues, and resources
+//
+// (not done in `init`, for keeping the package testable without a config file)
+func initialize() {
 	pwd := pwd()
 
 	// read from config file
@@ -182,29 +1046,150 @@ func init() {
 		}
 	}
 
+	// fill absent values with environment variables
+	conf = mergeEnvVars(conf, os.Getenv)
+
+	setVerbose(conf.IsVerbose)
+
 	// check values
 	if conf.TelegramMonitorIntervalSeconds <= 0 {
 		conf.TelegramMonitorIntervalSeconds = 1
 	}
+	if conf.LabelStyle == "" {
+		conf.LabelStyle = labelStyleInside
+	}
+	if conf.BadgeCorner == "" {
+		conf.BadgeCorner = badgeCornerTopLeft
+	}
+	if conf.PoseColoring == "" {
+		conf.PoseColoring = poseColoringPerson
+	}
+	if conf.PoseStrokeWidth <= 0 {
+		conf.PoseStrokeWidth = PoseStrokeWidth
+	}
+	if conf.PosePointRadius <= 0 {
+		conf.PosePointRadius = PosePointRadius
+	}
+	if conf.PoseTorsoStyle == "" {
+		conf.PoseTorsoStyle = poseTorsoCross
+	}
+	if conf.PoseSkeletonOnly && conf.PoseDotsOnly {
+		panic("Only one of pose-skeleton-only and pose-dots-only can be set")
+	}
+	if conf.ChatsFilepath == "" {
+		conf.ChatsFilepath = defaultChatsFilename
+	}
+	if conf.NumWorkers <= 0 {
+		conf.NumWorkers = defaultNumWorkers
+	}
+	if conf.JobQueueSize <= 0 {
+		conf.JobQueueSize = defaultJobQueueSize
+	}
+	if conf.ProductDetectionThreshold <= 0 {
+		conf.ProductDetectionThreshold = defaultProductDetectionThreshold
+	}
+	for source := range conf.ResultChatRoutes {
+		if _, err := strconv.ParseInt(source, 10, 64); err != nil {
+			panic(fmt.Sprintf("Invalid source chat id in result-chat-routes: %s", source))
+		}
+	}
+	switch conf.GroupTrigger {
+	case "":
+		conf.GroupTrigger = groupTriggerMentionOrReply
+	case groupTriggerMentionOrReply, groupTriggerMention, groupTriggerReply, groupTriggerAll:
+	default:
+		panic(fmt.Sprintf("Unknown group trigger: %s", conf.GroupTrigger))
+	}
+	if conf.ResultResolution == "" {
+		conf.ResultResolution = resultResolutionOriginal
+	} else if _, exists := resultResolutionSizes[conf.ResultResolution]; !exists && conf.ResultResolution != resultResolutionOriginal {
+		panic(fmt.Sprintf("Unknown result resolution: %s", conf.ResultResolution))
+	}
+	if conf.WatermarkCorner == "" {
+		conf.WatermarkCorner = badgeCornerBottomRight
+	}
+	if conf.WatermarkOpacity <= 0 || conf.WatermarkOpacity > 1 {
+		conf.WatermarkOpacity = defaultWatermarkOpacity
+	}
+	if conf.KakaoTimeoutSeconds <= 0 {
+		conf.KakaoTimeoutSeconds = defaultKakaoTimeoutSeconds
+	}
+	if conf.MaxDownloadBytes <= 0 {
+		conf.MaxDownloadBytes = defaultMaxDownloadBytes
+	}
+	if conf.MaxResultBytes <= 0 {
+		conf.MaxResultBytes = defaultMaxResultBytes
+	}
+	if conf.NSFWTileSize <= 0 {
+		conf.NSFWTileSize = defaultNSFWTileSize
+	}
+	if conf.NSFWTileConcurrency <= 0 {
+		conf.NSFWTileConcurrency = defaultNSFWTileConcurrency
+	}
+	if conf.LabelTextColor != "" {
+		c, err := parseHexColor(conf.LabelTextColor)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid label text color: %s", err))
+		}
+		labelTextColor = c
+	}
+
+	// command aliases
+	for alias, cmd := range conf.CommandAliases {
+		if visionCommandForCommand(cmd) == None {
+			panic(fmt.Sprintf("No such command for alias '%s': %s", alias, cmd))
+		}
 
-	// kakao api client
-	kakaoClient = kakaoapi.NewClient(conf.KakaoAPIKey)
-	kakaoClient.Verbose = conf.IsVerbose
+		cmdAliases[strings.ToLower(alias)] = cmd
+	}
+
+	// caption templates
+	for cmd, text := range conf.CaptionTemplates {
+		command := visionCommandForCommand(cmd)
+		if command == None {
+			panic(fmt.Sprintf("No such command for caption template: %s", cmd))
+		}
+
+		captionTemplates[command] = template.Must(template.New(cmd).Funcs(template.FuncMap{
+			"join": strings.Join,
+		}).Parse(text))
+	}
+
+	// kakao api clients
+	for _, key := range kakaoAPIKeys(conf) {
+		kakaoClient := kakaoapi.NewClient(key)
+		kakaoClient.Verbose = conf.IsVerbose
+
+		kakaoClients = append(kakaoClients, kakaoClient)
+	}
+	if len(kakaoClients) <= 0 && !conf.DryRun {
+		panic("No kakao rest api key was given")
+	}
 
 	// telegram bot client
 	client = bot.NewClient(conf.TelegramAPIToken)
 	client.Verbose = conf.IsVerbose
 
-	// loggly logger client
+	// per-chat settings
+	chatsFilepath = filepath.Join(pwd, conf.ChatsFilepath)
+	if err := loadChats(); err != nil {
+		log.Printf("Failed to load chat settings from %s: %s", chatsFilepath, err)
+	}
+
+	// image processing jobs queue
+	imageJobs = make(chan imageJob, conf.JobQueueSize)
+
+	// loggly logs queue
 	if conf.LogglyToken != "" {
-		logger = loggly.New(conf.LogglyToken)
+		logglyBulkURL = fmt.Sprintf(logglyBulkURLFormat, conf.LogglyToken)
+		logglyLogs = make(chan logglyLog, numQueuedLogglyLogs)
 	}
 
 	// others
-	bytes, err := ioutil.ReadFile(filepath.Join(pwd, fontFilepath))
+	fontBytes, err := ioutil.ReadFile(filepath.Join(pwd, fontFilepath))
 	if err == nil {
 		var f *truetype.Font
-		f, err = truetype.Parse(bytes)
+		f, err = truetype.Parse(fontBytes)
 		if err == nil {
 			font = f
 		} else {
@@ -213,26 +1198,68 @@ func init() {
 	} else {
 		panic(err)
 	}
-}
 
-func main() {
-	// catch SIGINT and SIGTERM and terminate gracefully
-	sig := make(chan os.Signal, 1)
+	emojiBytes := defaultEmojiBytes
+	if conf.EmojiFilepath != "" {
+		if emojiBytes, err = ioutil.ReadFile(filepath.Join(pwd, conf.EmojiFilepath)); err != nil {
+			panic(err)
+		}
+	}
+	if emoji, _, err = image.Decode(bytes.NewReader(emojiBytes)); err != nil {
+		panic(err)
+	}
+}
+
+func main() {
+	// batch mode: process images in a local directory and exit, without telegram
+	processDir := flag.String("process-dir", "", "process images in this directory and exit, without running the bot")
+	command := flag.String("command", allCmds[DetectFaces], "command for processing images in -process-dir (eg. detect_products)")
+	outputDir := flag.String("output-dir", "", "directory for annotated images of -process-dir (default: PROCESS_DIR/results)")
+	flag.Parse()
+
+	initialize()
+
+	if *processDir != "" {
+		// log locally only, as queued loggly logs would be dropped on exit
+		logglyLogs = nil
+
+		if err := processDirectory(*processDir, *outputDir, visionCommandForCommand(*command)); err != nil {
+			logError(fmt.Sprintf("Failed to process directory: %s", err))
+
+			os.Exit(1)
+		}
+		return
+	}
+
+	// catch SIGINT and SIGTERM and terminate gracefully
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-sig
 		os.Exit(1)
 	}()
 
+	// flush queued loggly logs in background
+	if logglyLogs != nil {
+		go sendLogglyLogs()
+	}
+
+	// start workers for processing images
+	for i := 0; i < conf.NumWorkers; i++ {
+		go processImageJobs(client)
+	}
+
 	// get info about this bot
 	if me := client.GetMe(); me.Ok {
 		logMessage(fmt.Sprintf("Starting bot: @%s (%s)", *me.Result.Username, me.Result.FirstName))
 
+		botUsername = *me.Result.Username
+
 		// delete webhook (getting updates will not work when wehbook is set up)
 		if unhooked := client.DeleteWebhook(true); unhooked.Ok {
 			// wait for new updates
-			client.StartMonitoringUpdates(
-				0,
+			monitorUpdates(
+				client,
 				conf.TelegramMonitorIntervalSeconds,
 				func(b *bot.Bot, update bot.Update, err error) {
 					if err == nil {
@@ -240,6 +1267,8 @@ func main() {
 							processUpdate(b, update) // process message
 						} else if update.HasCallbackQuery() {
 							processCallbackQuery(b, update) // process callback query
+						} else if update.HasPoll() {
+							processPoll(update) // log results of labeling polls
 						} else {
 							logError("Update not processable")
 						}
@@ -256,14 +1285,195 @@ func main() {
 	}
 }
 
+// extensions of image files (for batch mode, and documents sent with unknown mime types)
+var imageFileExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".bmp": true, ".tif": true, ".tiff": true, ".webp": true,
+}
+
+// run given command on every image file in given directory, and write annotated images to the output directory
+//
+// (for bulk jobs and testing the drawing code offline; only commands which result in an image are supported)
+func processDirectory(dir, outputDir string, command VisionCommand) error {
+	switch command {
+	case DetectFaces, MaskFaces, EmojiFaces, BlurBackground, DetectProducts, AnalyzePoses, PoseSilhouette, ExtractTexts:
+	default:
+		return fmt.Errorf("command not supported in batch mode: '%s'", command)
+	}
+
+	client := nextKakaoClient()
+	if client == nil {
+		return fmt.Errorf("no kakao api client is available (dry-run?)")
+	}
+	kakaoClient := timedKakaoClient{client}
+
+	if outputDir == "" {
+		outputDir = filepath.Join(dir, "results")
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, file := range files {
+		ext := strings.ToLower(filepath.Ext(file.Name()))
+		if file.IsDir() || !imageFileExtensions[ext] {
+			continue
+		}
+
+		path := filepath.Join(dir, file.Name())
+		outPath := filepath.Join(outputDir, fmt.Sprintf("%s_%s.jpg", strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())), allCmds[command]))
+
+		if err := processFile(kakaoClient, path, outPath, command); err != nil {
+			failed++
+
+			logError(fmt.Sprintf("Failed to process %s: %s", path, err))
+		} else {
+			logMessage(fmt.Sprintf("Processed '%s': %s -> %s", command, path, outPath))
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to process %d file(s)", failed)
+	}
+	return nil
+}
+
+// run given command on an image file, and write the annotated image to given path
+func processFile(kakaoClient timedKakaoClient, path, outPath string, command VisionCommand) error {
+	correlationID := newCorrelationID()
+
+	imgBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	img, err := decodeImage(correlationID, imgBytes)
+	if err != nil {
+		return err
+	}
+
+	var newImg image.Image
+	switch command {
+	case DetectFaces, MaskFaces, EmojiFaces, BlurBackground:
+		var detected kakaoapi.ResponseDetectedFace
+		if detected, _, err = detectFaces(kakaoClient, imgBytes, 0.7); err == nil {
+			newImg = processImageForFaces(img, detected, command, maskStylePixelate, colors)
+		}
+	case DetectProducts:
+		var detected kakaoapi.ResponseDetectedProduct
+		if detected, err = kakaoClient.DetectProductFromBytes(imgBytes, conf.ProductDetectionThreshold); err == nil {
+			detected, _ = suppressOverlappingProducts(detected)
+			newImg, _ = processImageForProducts(img, detected, colors)
+		}
+	case AnalyzePoses, PoseSilhouette:
+		var analyzed kakaoapi.ResponseAnalyzedPose
+		if conf.MirrorPoses {
+			analyzed, err = analyzeMirroredPoses(kakaoClient, correlationID, imgBytes)
+		} else {
+			analyzed, err = kakaoClient.AnalyzePoseFromBytes(imgBytes)
+		}
+		if err == nil {
+			if command == PoseSilhouette {
+				newImg = processImageForPoseSilhouette(img, analyzed, colors)
+			} else {
+				newImg = processImageForPoses(img, analyzed, colors)
+			}
+		}
+	case ExtractTexts:
+		var detected kakaoapi.ResponseDetectedText
+		if detected, err = kakaoClient.DetectTextFromBytes(imgBytes); err == nil {
+			if !conf.OCRRawOrder {
+				detected = sortTextsInReadingOrder(detected)
+			}
+			newImg, _ = processImageForTexts(img, detected, colors)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, resizeResult(newImg), nil); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(outPath, buf.Bytes(), 0644)
+}
+
+// poll updates like `StartMonitoringUpdates`, but back off exponentially (with jitter) on consecutive errors
+func monitorUpdates(b *bot.Bot, interval int, updateHandler func(b *bot.Bot, update bot.Update, err error)) {
+	options := bot.OptionsGetUpdates{}.
+		SetOffset(0).
+		SetLimit(100).
+		SetTimeout(1)
+
+	var offset int64
+	failures := 0
+	for {
+		if updates := b.GetUpdates(options); updates.Ok {
+			failures = 0
+
+			for _, update := range updates.Result {
+				// update offset (max + 1)
+				if offset <= update.UpdateID {
+					offset = update.UpdateID + 1
+					options.SetOffset(offset)
+				}
+
+				go updateHandler(b, update, nil)
+			}
+		} else {
+			failures++
+
+			description := "unknown error"
+			if updates.Description != nil {
+				description = *updates.Description
+			}
+			go updateHandler(b, bot.Update{}, fmt.Errorf("%s (%d consecutive failure(s))", description, failures))
+		}
+
+		time.Sleep(pollingDelay(interval, failures))
+	}
+}
+
+// delay before the next polling: given interval, or exponentially increasing one (capped, with jitter) on failures
+func pollingDelay(interval, failures int) time.Duration {
+	delay := time.Duration(interval) * time.Second
+	if failures <= 0 {
+		return delay
+	}
+
+	maxDelay := PollingBackoffMaxSeconds * time.Second
+	for i := 0; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	// full jitter on the latter half
+	return delay/2 + time.Duration(mathrand.Int63n(int64(delay/2)+1))
+}
+
+// log message only when verbose logging is on
+func logVerbose(message string) {
+	if isVerbose() {
+		logMessage(message)
+	}
+}
+
 // log message
 func logMessage(message string) {
 	log.Println(message)
 
-	if logger != nil {
+	if logglyLogs != nil {
 		_, timestamp := loggly.Timestamp()
 
-		logger.Log(logglyLog{
+		enqueueLogglyLog(logglyLog{
 			Application: appName,
 			Severity:    "Log",
 			Timestamp:   timestamp,
@@ -276,10 +1486,10 @@ func logMessage(message string) {
 func logError(message string) {
 	log.Println(message)
 
-	if logger != nil {
+	if logglyLogs != nil {
 		_, timestamp := loggly.Timestamp()
 
-		logger.Log(logglyLog{
+		enqueueLogglyLog(logglyLog{
 			Application: appName,
 			Severity:    "Error",
 			Timestamp:   timestamp,
@@ -289,50 +1499,201 @@ func logError(message string) {
 }
 
 // log request from user
-func logRequest(username, fileURL string, command VisionCommand) {
-	if logger != nil {
+func logRequest(correlationID, username, fileURL string, command VisionCommand) {
+	if logglyLogs != nil {
 		_, timestamp := loggly.Timestamp()
 
-		logger.Log(logglyLog{
+		enqueueLogglyLog(logglyLog{
 			Application: appName,
 			Severity:    "Verbose",
 			Timestamp:   timestamp,
 			Object: struct {
-				Username string        `json:"username"`
-				FileURL  string        `json:"file_url"`
-				Command  VisionCommand `json:"command"`
+				CorrelationID string        `json:"correlation_id"`
+				Username      string        `json:"username"`
+				FileURL       string        `json:"file_url"`
+				Command       VisionCommand `json:"command"`
 			}{
-				Username: username,
-				FileURL:  fileURL,
-				Command:  command,
+				CorrelationID: correlationID,
+				Username:      username,
+				FileURL:       fileURL,
+				Command:       command,
 			},
 		})
 	}
 }
 
+// enqueue a log for Loggly without blocking (drops it when the queue is full)
+func enqueueLogglyLog(l logglyLog) {
+	select {
+	case logglyLogs <- l:
+	default:
+		log.Printf("Loggly log queue is full, dropping log: %+v", l)
+	}
+}
+
+// send queued logs to Loggly in batches, periodically or when a batch is full
+//
+// (failures are logged locally, so that logging never blocks the update loop)
+func sendLogglyLogs() {
+	ticker := time.NewTicker(logglyFlushIntervalSeconds * time.Second)
+	defer ticker.Stop()
+
+	batch := []logglyLog{}
+	for {
+		select {
+		case l := <-logglyLogs:
+			batch = append(batch, l)
+			if len(batch) < logglyBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) <= 0 {
+				continue
+			}
+		}
+
+		if err := postLogglyLogs(batch); err != nil {
+			log.Printf("Failed to send %d log(s) to Loggly: %s", len(batch), err)
+		}
+		batch = []logglyLog{}
+	}
+}
+
+// post given logs to Loggly's bulk endpoint (newline-separated JSON objects)
+func postLogglyLogs(logs []logglyLog) error {
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	for _, l := range logs {
+		if err := encoder.Encode(l); err != nil {
+			return err
+		}
+	}
+
+	response, err := logglyHTTPClient.Post(logglyBulkURL, "text/plain", buf)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// mime type of given document (empty if unknown)
+func mimeTypeOf(document *bot.Document) string {
+	if document.MimeType == nil {
+		return ""
+	}
+	return *document.MimeType
+}
+
+// check if the file name of given document has an image extension (eg. `.jpg`)
+func hasImageFileExtension(document *bot.Document) bool {
+	if document.FileName == nil {
+		return false
+	}
+	return imageFileExtensions[strings.ToLower(filepath.Ext(*document.FileName))]
+}
+
 // process incoming update from Telegram
 func processUpdate(b *bot.Bot, update bot.Update) bool {
 	result := false // process result
 
 	var message string
+	chatID := update.Message.Chat.ID
 	options := bot.OptionsSendMessage{}.SetReplyToMessageID(update.Message.MessageID)
 
-	if update.Message.HasPhoto() {
-		options.SetReplyMarkup(bot.InlineKeyboardMarkup{
-			InlineKeyboard: genImageInlineKeyboards(update.Message.LargestPhoto().FileID),
+	// ignore messages in group chats which don't trigger the bot (for not replying to every image)
+	isGroup := isGroupChat(update.Message.Chat)
+	if isGroup && !isTriggeredInGroup(update.Message) {
+		return false
+	}
+
+	// file id of the received image (if any)
+	fileID := imageFileIDOf(update.Message)
+	if fileID == "" && isGroup && update.Message.ReplyToMessage != nil && mentionsBot(update.Message) {
+		fileID = imageFileIDOf(update.Message.ReplyToMessage) // mentioned in a reply to an image
+	}
+	if fileID == "" && update.Message.HasText() && strings.HasPrefix(*update.Message.Text, "data:") {
+		var err error
+		if fileID, err = storeDataURIImage(*update.Message.Text); err != nil {
+			logError(fmt.Sprintf("Failed to read image from data URI: %s", err))
+
+			sendMessage(b, chatID, fmt.Sprintf(messageInvalidDataURI, err), options)
+
+			return false
+		}
+	}
+
+	if fileID != "" {
+		// remember it for `/last`
+		updateChatSettings(chatID, func(settings *chatSettings) {
+			settings.LastFileID = fileID
 		})
-		message = messageActionImage
-	} else if update.Message.HasDocument() && strings.HasPrefix(*update.Message.Document.MimeType, "image/") {
+
+		// remember where it was forwarded from
+		if attribution := forwardAttribution(update.Message); attribution != "" {
+			fileAttributionsLock.Lock()
+			fileAttributions[fileID] = attribution
+			fileAttributionsLock.Unlock()
+		}
+
+		// process immediately if a default command is set for this chat
+		if command := chatSettingsFor(chatID).DefaultCommand; command != None {
+			return processImageWithCommand(b, chatID, update.Message.MessageID, update.Message.From, fileID, command)
+		}
+
 		options.SetReplyMarkup(bot.InlineKeyboardMarkup{
-			InlineKeyboard: genImageInlineKeyboards(update.Message.Document.FileID),
+			InlineKeyboard: genImageInlineKeyboards(chatID, fileID, languageCodeOf(update.Message.From)),
 		})
 		message = messageActionImage
+	} else if isTextCommand(update.Message, textCommandAgain) {
+		// run the last command on the last image
+		settings := chatSettingsFor(chatID)
+		if settings.LastFileID != "" && settings.LastCommand != None && isCommandAllowed(chatID, settings.LastCommand) {
+			return processImageWithCommand(b, chatID, update.Message.MessageID, update.Message.From, settings.LastFileID, settings.LastCommand)
+		}
+
+		message = "No command was run on an image yet."
+	} else if isTextCommand(update.Message, textCommandSelfTest) {
+		if !isAdminChat(chatID) {
+			message = messageNotAllowed
+		} else {
+			// (runs in background for not blocking other updates)
+			go runSelfTest(b, chatID, update.Message.MessageID)
+
+			b.SendChatAction(chatID, bot.ChatActionTyping)
+
+			return true
+		}
+	} else if update.Message.HasText() && strings.HasPrefix(*update.Message.Text, "/") {
+		var keyboard [][]bot.InlineKeyboardButton
+		message, keyboard = processTextCommand(update.Message)
+
+		if keyboard != nil {
+			options.SetReplyMarkup(bot.InlineKeyboardMarkup{
+				InlineKeyboard: keyboard,
+			})
+		}
+	} else if step, exists := pendingStepOf(update.Message); exists {
+		// consume the reply for the pending step
+		var keyboard [][]bot.InlineKeyboardButton
+		message, keyboard = pendingStepHandlers[step.kind](update.Message)
+
+		if keyboard != nil {
+			options.SetReplyMarkup(bot.InlineKeyboardMarkup{
+				InlineKeyboard: keyboard,
+			})
+		}
 	} else {
 		message = messageHelp
 	}
 
 	// send message
-	if sent := b.SendMessage(update.Message.Chat.ID, message, options); sent.Ok {
+	if sent := sendMessage(b, chatID, message, options); sent.Ok {
 		result = true
 	} else {
 		logError(fmt.Sprintf("Failed to send message: %s", *sent.Description))
@@ -341,694 +1702,4717 @@ func processUpdate(b *bot.Bot, update bot.Update) bool {
 	return result
 }
 
-// process incoming callback query
-func processCallbackQuery(b *bot.Bot, update bot.Update) (result bool) {
-	// process result
-	result = false
+// file id of the image (or a document which can be processed as an image) in given message, empty if none
+func imageFileIDOf(message *bot.Message) string {
+	if message.HasPhoto() {
+		return message.LargestPhoto().FileID
+	} else if message.HasDocument() && strings.HasPrefix(mimeTypeOf(message.Document), "image/") {
+		return message.Document.FileID
+	} else if message.HasDocument() && mimeTypeOf(message.Document) == "application/pdf" {
+		return message.Document.FileID // will be processed with the image of its first page
+	} else if message.HasDocument() && hasImageFileExtension(message.Document) {
+		return message.Document.FileID // sent with an unknown mime type (eg. application/octet-stream), will be sniffed after download
+	}
 
-	var username string
-	message := ""
-	query := *update.CallbackQuery
-	data := *query.Data
+	return ""
+}
 
-	if data == commandCancel {
-		message = messageCanceled
-	} else {
-		parsedCommand := strings.Split(data, "/")
+// whether given chat is a group (or a supergroup)
+func isGroupChat(chat bot.Chat) bool {
+	return chat.Type == bot.ChatTypeGroup || chat.Type == chatTypeSupergroup
+}
 
-		if len(parsedCommand) >= 2 {
-			command := parsedCommand[0]
-			shortenedFileID := parsedCommand[1]
+// whether given message in a group chat should be handled, as configured with `group-trigger`
+//
+// (text commands, and replies to pending steps of multi-step commands are always handled)
+func isTriggeredInGroup(message *bot.Message) bool {
+	if message.HasText() && strings.HasPrefix(*message.Text, "/") {
+		return true
+	}
+	if hasPendingStep(message) {
+		return true
+	}
 
-			if fileID, exists := fileIDs[shortenedFileID]; exists {
-				if fileResult := b.GetFile(fileID); fileResult.Ok {
-					fileURL := b.GetFileURL(*fileResult.Result)
+	switch conf.GroupTrigger {
+	case groupTriggerAll:
+		return true
+	case groupTriggerMention:
+		return mentionsBot(message)
+	case groupTriggerReply:
+		return isReplyToBot(message)
+	default:
+		return mentionsBot(message) || isReplyToBot(message)
+	}
+}
 
-					if strings.Contains(*query.Message.Text, "image") {
-						visionCommand := visionCommandForCommand(command)
+// whether given message (its text or caption) mentions this bot
+func mentionsBot(message *bot.Message) bool {
+	if botUsername == "" {
+		return false
+	}
 
-						go processImage(b, query.Message.Chat.ID, query.Message.MessageID, fileURL, visionCommand)
+	text := ""
+	if message.HasText() {
+		text = *message.Text
+	} else if message.Caption != nil {
+		text = *message.Caption
+	}
 
-						message = fmt.Sprintf("Processing '%s' on received image...", visionCommand)
+	return strings.Contains(strings.ToLower(text), "@"+strings.ToLower(botUsername))
+}
 
-						// log request
-						if query.From.Username == nil {
-							username = query.From.FirstName
-						} else {
-							username = *query.From.Username
-						}
-						logRequest(username, fileURL, visionCommand)
-					} else {
-						message = messageUnprocessable
-					}
-				} else {
-					logError(fmt.Sprintf("Failed to get file from url: %s", *fileResult.Description))
+// whether given message is a reply to a message of this bot
+func isReplyToBot(message *bot.Message) bool {
+	replied := message.ReplyToMessage
+	if replied == nil || replied.From == nil || replied.From.Username == nil {
+		return false
+	}
 
-					message = messageFailedToGetFile
-				}
-			} else {
-				logError(fmt.Sprintf("Failed to get file id from shortened file id: `%s`, maybe bot was restarted?", shortenedFileID))
+	return replied.From.IsBot && strings.EqualFold(*replied.From.Username, botUsername)
+}
 
-				message = messageFailedToGetFile
+// process text command (eg. `/default detect_faces`) and return the reply message (and inline keyboards, if needed)
+func processTextCommand(message *bot.Message) (string, [][]bot.InlineKeyboardButton) {
+	chatID := message.Chat.ID
+	command, params := parseTextCommand(*message.Text)
+
+	switch command {
+	case textCommandDefault:
+		if len(params) <= 0 {
+			if command := chatSettingsFor(chatID).DefaultCommand; command != None {
+				return fmt.Sprintf("Default command is '%s'.", command), nil
 			}
-		} else {
-			logError(fmt.Sprintf("Failed to parse command: %s", data))
 
-			message = messageUnprocessable
+			// ask which command to set, and consume the next reply
+			if message.From != nil {
+				setPendingStep(message.From.ID, chatID, stepKindDefaultCommand)
+
+				return "No default command is set. Send a command to set as default (eg. detect_faces), or /cancel.", nil
+			}
+			return "No default command is set.", nil
 		}
-	}
 
-	// answer callback query
-	if apiResult := b.AnswerCallbackQuery(query.ID, nil); apiResult.Ok {
-		// edit message and remove inline keyboards
-		if apiResult := b.EditMessageText(
-			message,
-			bot.OptionsEditMessageText{}.SetIDs(query.Message.Chat.ID, query.Message.MessageID),
-		); apiResult.Ok {
-			result = true
-		} else {
-			logError(fmt.Sprintf("Failed to edit message text: %s", *apiResult.Description))
+		return setDefaultCommand(chatID, params[0]), nil
+	case textCommandLast:
+		if fileID := chatSettingsFor(chatID).LastFileID; fileID != "" {
+			return messageActionImage, genImageInlineKeyboards(chatID, fileID, languageCodeOf(message.From))
 		}
-	} else {
-		logError(fmt.Sprintf("Failed to answer callback query: %+v", query))
+
+		return "No image was received yet.", nil
+	case textCommandCancel:
+		clearPendingChatState(chatID)
+		if message.From != nil {
+			clearPendingStep(message.From.ID)
+		}
+
+		return messageCanceled, nil
+	case textCommandWhoAmI:
+		return whoAmI(message), nil
+	case textCommandColors:
+		return setColors(chatID, params), nil
+	case textCommandVerbose:
+		if !isAdminChat(chatID) {
+			return messageNotAllowed, nil
+		}
+
+		if len(params) > 0 && (params[0] == textParamOn || params[0] == textParamOff) {
+			setVerbose(params[0] == textParamOn)
+
+			logMessage(fmt.Sprintf("Verbose logging is turned %s", onOff(isVerbose())))
+		}
+
+		return fmt.Sprintf("Verbose logging is %s.", onOff(isVerbose())), nil
 	}
 
-	return result
+	return messageHelp, nil
 }
 
-// read bytes from given url
-func readBytes(url string) (bytes []byte, err error) {
-	var response *http.Response
-	response, err = http.Get(url)
-	if err != nil {
-		return nil, err
+// ids and locale of the sender and the chat of given message
+func whoAmI(message *bot.Message) string {
+	lines := []string{}
+	if message.From != nil {
+		languageCode := "unknown"
+		if message.From.LanguageCode != nil {
+			languageCode = *message.From.LanguageCode
+		}
+
+		lines = append(lines,
+			fmt.Sprintf("User ID: %d", message.From.ID),
+			fmt.Sprintf("Username: %s", usernameOf(message.From)),
+			fmt.Sprintf("Language: %s", languageCode),
+		)
 	}
+	lines = append(lines,
+		fmt.Sprintf("Chat ID: %d", message.Chat.ID),
+		fmt.Sprintf("Chat type: %s", message.Chat.Type),
+	)
 
-	defer response.Body.Close()
+	return strings.Join(lines, "\n")
+}
 
-	bytes, err = ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
+// set default command of given chat with given parameter (command or `off`), and return the reply message
+func setDefaultCommand(chatID int64, param string) string {
+	if param == textParamOff {
+		updateChatSettings(chatID, func(settings *chatSettings) {
+			settings.DefaultCommand = None
+		})
+		return "Default command is cleared."
 	}
 
-	return bytes, nil
+	if visionCommand := visionCommandForCommand(param); visionCommand != None && isCommandAllowed(chatID, visionCommand) {
+		updateChatSettings(chatID, func(settings *chatSettings) {
+			settings.DefaultCommand = visionCommand
+		})
+		return fmt.Sprintf("Default command is set to '%s'. Images will be processed without selecting an action.", visionCommand)
+	}
+
+	return fmt.Sprintf("No such command: %s", param)
 }
 
-func processImageForFaces(img image.Image, detected kakaoapi.ResponseDetectedFace, command VisionCommand) image.Image {
-	var err error
+// set colors of annotations for given chat with given parameters (hex colors or `off`), and return the reply message
+func setColors(chatID int64, params []string) string {
+	if len(params) <= 0 {
+		if hexes := chatSettingsFor(chatID).Colors; len(hexes) > 0 {
+			return fmt.Sprintf("Colors are: %s", strings.Join(hexes, " "))
+		}
+		return "Default colors are used."
+	}
 
-	// image's width and height
-	width, height := float64(detected.Result.Width), float64(detected.Result.Height)
+	if params[0] == textParamOff {
+		updateChatSettings(chatID, func(settings *chatSettings) {
+			settings.Colors = nil
+		})
+		return "Colors are reset to default."
+	}
 
-	// copy to a new image
-	newImg := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
-	draw.Draw(newImg, newImg.Bounds(), img, image.ZP, draw.Src)
-	gc := draw2dimg.NewGraphicContext(newImg)
-	gc.SetLineWidth(StrokeWidth)
-	gc.SetFillColor(color.Transparent)
+	hexes := []string{}
+	for _, param := range params {
+		c, err := parseHexColor(param)
+		if err != nil {
+			return fmt.Sprintf("Invalid color: %s (should be like #FF0000)", param)
+		}
+		hexes = append(hexes, hexOfColor(c))
+	}
 
-	// build up facial attributes string
-	for i, f := range detected.Result.Faces {
-		switch command {
-		case DetectFaces:
-			// prepare freetype font
-			fc := freetype.NewContext()
-			fc.SetFont(font)
-			fc.SetDPI(72)
-			fc.SetClip(newImg.Bounds())
-			fc.SetDst(newImg)
-			fontSize := float64(newImg.Bounds().Dy()) / 24.0
-			fc.SetFontSize(fontSize)
+	updateChatSettings(chatID, func(settings *chatSettings) {
+		settings.Colors = hexes
+	})
+	return fmt.Sprintf("Colors are set to: %s", strings.Join(hexes, " "))
+}
 
-			// set color
-			color := colorForIndex(i)
-			gc.SetStrokeColor(color)
-			fc.SetSrc(&image.Uniform{color})
+// toggle verbose logging of this bot at runtime
+//
+// (`Verbose` of the bot client and kakao api clients are not changed, as they are read by in-flight requests
+// without synchronization; they keep the value of `is-verbose` in the config file)
+func setVerbose(on bool) {
+	value := int32(0)
+	if on {
+		value = 1
+	}
+	atomic.StoreInt32(&verbose, value)
+}
 
-			// draw rectangles and their indices on detected faces
-			gc.MoveTo(width*f.X, height*f.Y)
-			gc.LineTo(width*(f.X+f.W), height*f.Y)
-			gc.LineTo(width*(f.X+f.W), height*(f.Y+f.H))
-			gc.LineTo(width*f.X, height*(f.Y+f.H))
-			gc.LineTo(width*f.X, height*f.Y)
-			gc.Close()
-			gc.FillStroke()
+// whether verbose logging is on
+func isVerbose() bool {
+	return atomic.LoadInt32(&verbose) == 1
+}
 
-			// draw face label
-			if _, err = fc.DrawString(
-				fmt.Sprintf("Face #%d", i+1),
-				freetype.Pt(
-					int(width*f.X+5),
-					int(fc.PointToFixed(height*(f.Y+f.H)-5)>>6),
-				),
-			); err != nil {
-				logError(fmt.Sprintf("Failed to draw string: %s", err))
-			}
+// "on" or "off"
+func onOff(on bool) string {
+	if on {
+		return textParamOn
+	}
+	return textParamOff
+}
 
-			// mark nose
-			nosePoints := f.FacialPoints.Nose
-			for _, n := range nosePoints {
-				gc.MoveTo(width*n.X(), height*n.Y())
-				gc.ArcTo(width*n.X(), height*n.Y(), CircleRadius, CircleRadius, 0, -math.Pi*2)
-				gc.Close()
-				gc.FillStroke()
-			}
+// pending step of a multi-step command, waiting for the next reply of a user
+type pendingStep struct {
+	chatID    int64
+	kind      string
+	expiresAt time.Time
+}
 
-			// mark right eye
-			rightEyePoints := f.FacialPoints.RightEye
-			for _, r := range rightEyePoints {
-				gc.MoveTo(width*r.X(), height*r.Y())
-				gc.ArcTo(width*r.X(), height*r.Y(), CircleRadius, CircleRadius, 0, -math.Pi*2)
-				gc.Close()
-				gc.FillStroke()
-			}
+// kinds of pending steps
+const (
+	stepKindDefaultCommand = "default_command" // waiting for a command to set as default
+)
 
-			// mark left pupil
-			leftEyePoints := f.FacialPoints.LeftEye
-			for _, l := range leftEyePoints {
-				gc.MoveTo(width*l.X(), height*l.Y())
-				gc.ArcTo(width*l.X(), height*l.Y(), CircleRadius, CircleRadius, 0, -math.Pi*2)
-				gc.Close()
-				gc.FillStroke()
-			}
+// pending steps (key: user id), expired ones are cleaned up in `PendingStepTTLSeconds`
+var pendingSteps = map[int64]pendingStep{}
+var pendingStepsLock sync.Mutex
+
+// handlers of pending steps (key: kind), which return the reply message (and inline keyboards, if needed)
+//
+// (a handler can set another pending step for asking more)
+var pendingStepHandlers = map[string]func(message *bot.Message) (string, [][]bot.InlineKeyboardButton){
+	stepKindDefaultCommand: func(message *bot.Message) (string, [][]bot.InlineKeyboardButton) {
+		return setDefaultCommand(message.Chat.ID, strings.TrimSpace(*message.Text)), nil
+	},
+}
 
-			// mark lips
-			lipPoints := f.FacialPoints.Lip
-			for _, l := range lipPoints {
-				gc.MoveTo(width*l.X(), height*l.Y())
-				gc.ArcTo(width*l.X(), height*l.Y(), CircleRadius, CircleRadius, 0, -math.Pi*2)
-				gc.Close()
-				gc.FillStroke()
-			}
-		case MaskFaces:
-			// pixelate face rects
-			g := gift.New(
-				gift.Pixelate(int(width * f.W / 8)),
-			)
-			g.DrawAt(
-				newImg,
-				newImg.SubImage(image.Rect(
-					int(width*f.X),
-					int(height*f.Y),
-					int(width*(f.X+f.W)),
-					int(height*(f.Y+f.H)),
-				)),
-				image.Pt(
-					int(width*f.X),
-					int(height*f.Y),
-				),
-				gift.CopyOperator,
-			)
+// remove expired pending steps
+//
+// (should be called while holding `pendingStepsLock`)
+func evictExpiredPendingSteps() {
+	now := time.Now()
+	for userID, step := range pendingSteps {
+		if now.After(step.expiresAt) {
+			delete(pendingSteps, userID)
 		}
 	}
-	gc.Save()
+}
 
-	return newImg
+// wait for the next reply of given user in given chat
+func setPendingStep(userID, chatID int64, kind string) {
+	pendingStepsLock.Lock()
+	defer pendingStepsLock.Unlock()
+
+	evictExpiredPendingSteps()
+
+	pendingSteps[userID] = pendingStep{
+		chatID:    chatID,
+		kind:      kind,
+		expiresAt: time.Now().Add(PendingStepTTLSeconds * time.Second),
+	}
 }
 
-func processImageForProducts(img image.Image, detected kakaoapi.ResponseDetectedProduct) (image.Image, []string) {
-	var err error
+// take out the pending step of given user in given chat (if any)
+func takePendingStep(userID, chatID int64) (step pendingStep, exists bool) {
+	pendingStepsLock.Lock()
+	defer pendingStepsLock.Unlock()
 
-	// image's width and height
-	width, height := float64(detected.Result.Width), float64(detected.Result.Height)
+	evictExpiredPendingSteps()
 
-	newImg := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
-	draw.Draw(newImg, newImg.Bounds(), img, image.ZP, draw.Src)
-	gc := draw2dimg.NewGraphicContext(newImg)
-	gc.SetLineWidth(StrokeWidth)
-	gc.SetFillColor(color.Transparent)
+	if step, exists = pendingSteps[userID]; exists && step.chatID == chatID {
+		delete(pendingSteps, userID)
+		return step, true
+	}
+	return pendingStep{}, false
+}
 
-	// build up facial attributes string
-	classes := []string{}
-	for i, o := range detected.Result.Objects {
-		classes = append(classes, o.Class)
+// whether there is a pending step which given text message may reply to (without taking it out)
+func hasPendingStep(message *bot.Message) bool {
+	if message.From == nil || !message.HasText() {
+		return false
+	}
 
-		// prepare freetype font
-		fc := freetype.NewContext()
-		fc.SetFont(font)
-		fc.SetDPI(72)
-		fc.SetClip(newImg.Bounds())
-		fc.SetDst(newImg)
-		fontSize := float64(newImg.Bounds().Dy()) / 24.0
-		fc.SetFontSize(fontSize)
+	pendingStepsLock.Lock()
+	defer pendingStepsLock.Unlock()
 
-		// set color
-		color := colorForIndex(i)
-		gc.SetStrokeColor(color)
-		fc.SetSrc(&image.Uniform{color})
+	evictExpiredPendingSteps()
 
-		// draw rectangles and their indices on detected product
-		gc.MoveTo(width*o.X1, height*o.Y1)
-		gc.LineTo(width*o.X1, height*o.Y2)
-		gc.LineTo(width*o.X2, height*o.Y2)
-		gc.LineTo(width*o.X2, height*o.Y1)
-		gc.LineTo(width*o.X1, height*o.Y1)
-		gc.Close()
-		gc.FillStroke()
+	step, exists := pendingSteps[message.From.ID]
+	return exists && step.chatID == message.Chat.ID
+}
 
-		// draw product label
-		if _, err = fc.DrawString(
-			fmt.Sprintf("#%d: %s", i+1, o.Class),
-			freetype.Pt(
-				int(width*o.X1+5),
-				int(fc.PointToFixed(height*o.Y2-5)>>6),
-			),
-		); err != nil {
-			logError(fmt.Sprintf("Failed to draw string: %s", err))
-		}
+// take out the pending step which given text message replies to (if any)
+func pendingStepOf(message *bot.Message) (pendingStep, bool) {
+	if message.From == nil || !message.HasText() {
+		return pendingStep{}, false
 	}
-	gc.Save()
+	return takePendingStep(message.From.ID, message.Chat.ID)
+}
 
-	return newImg, classes
+// stop waiting for the next reply of given user
+func clearPendingStep(userID int64) {
+	pendingStepsLock.Lock()
+	defer pendingStepsLock.Unlock()
+
+	delete(pendingSteps, userID)
 }
 
-func processImageForPoses(img image.Image, analyzed kakaoapi.ResponseAnalyzedPose) image.Image {
-	// copy to a new image
-	newImg := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
-	draw.Draw(newImg, newImg.Bounds(), img, image.ZP, draw.Src)
-	gc := draw2dimg.NewGraphicContext(newImg)
-	gc.SetLineWidth(StrokeWidth)
-	gc.SetFillColor(color.Transparent)
+// clear pending states of given chat
+func clearPendingChatState(chatID int64) {
+	updateChatSettings(chatID, func(settings *chatSettings) {
+		settings.DefaultCommand = None
+	})
+}
 
-	// draw lines on poses
-	for i, pose := range analyzed {
-		// set stroke color
-		color := colorForIndex(i)
-		gc.SetStrokeColor(color)
+// parse text command and its parameters (eg. `/default@bot_name detect_faces` => "default", ["detect_faces"])
+func parseTextCommand(text string) (command string, params []string) {
+	fields := strings.Fields(text)
+	if len(fields) <= 0 {
+		return "", nil
+	}
 
-		// mark keypoints and connect them
+	command = strings.SplitN(strings.TrimPrefix(fields[0], "/"), "@", 2)[0]
 
-		// nose
-		noseX, noseY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexNose)
-		gc.MoveTo(noseX, noseY)
-		gc.ArcTo(noseX, noseY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+	return command, fields[1:]
+}
 
-		// left eye
-		leftEyeX, leftEyeY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexLeftEye)
-		gc.MoveTo(leftEyeX, leftEyeY)
-		gc.ArcTo(leftEyeX, leftEyeY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+// run every detector on the sample image, and reply with their results and latencies
+func runSelfTest(b *bot.Bot, chatID, messageID int64) {
+	correlationID := newCorrelationID()
 
-		// right eye
-		rightEyeX, rightEyeY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexRightEye)
-		gc.MoveTo(rightEyeX, rightEyeY)
-		gc.ArcTo(rightEyeX, rightEyeY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+	var message string
+	if client := nextKakaoClient(); client != nil {
+		kakaoClient := timedKakaoClient{client}
+
+		tests := []struct {
+			command VisionCommand
+			run     func() error
+		}{
+			{DetectFaces, func() (err error) {
+				_, err = kakaoClient.DetectFaceFromBytes(selfTestImageBytes, 0.7)
+				return err
+			}},
+			{DetectProducts, func() (err error) {
+				_, err = kakaoClient.DetectProductFromBytes(selfTestImageBytes, conf.ProductDetectionThreshold)
+				return err
+			}},
+			{DetectNSFW, func() (err error) {
+				_, err = kakaoClient.DetectNSFWFromBytes(selfTestImageBytes)
+				return err
+			}},
+			{Tag, func() (err error) {
+				_, err = kakaoClient.GenerateTagsFromBytes(selfTestImageBytes)
+				return err
+			}},
+			{AnalyzePoses, func() (err error) {
+				_, err = kakaoClient.AnalyzePoseFromBytes(selfTestImageBytes)
+				return err
+			}},
+			{ExtractTexts, func() (err error) {
+				_, err = kakaoClient.DetectTextFromBytes(selfTestImageBytes)
+				return err
+			}},
+		}
 
-		// left ear
-		leftEarX, leftEarY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexLeftEar)
-		gc.MoveTo(leftEarX, leftEarY)
-		gc.ArcTo(leftEarX, leftEarY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+		lines := []string{}
+		passed := 0
+		for _, test := range tests {
+			started := time.Now()
+			err := test.run()
+			elapsed := time.Since(started).Round(time.Millisecond)
 
-		// right ear
-		rightEarX, rightEarY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexRightEar)
-		gc.MoveTo(rightEarX, rightEarY)
-		gc.ArcTo(rightEarX, rightEarY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+			if err == nil {
+				passed++
+				lines = append(lines, fmt.Sprintf("✅ %s (%s)", test.command, elapsed))
+			} else {
+				lines = append(lines, fmt.Sprintf("❌ %s (%s): %s", test.command, elapsed, err))
+			}
+		}
 
-		// left shoulder
-		leftShoulderX, leftShoulderY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexLeftShoulder)
-		gc.MoveTo(leftShoulderX, leftShoulderY)
-		gc.ArcTo(leftShoulderX, leftShoulderY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+		message = fmt.Sprintf("Self test: %d/%d passed\n\n%s", passed, len(tests), strings.Join(lines, "\n"))
+	} else {
+		message = "Self test: no kakao api client is available (dry-run?)"
+	}
 
-		// right shoulder
-		rightShoulderX, rightShoulderY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexRightShoulder)
-		gc.MoveTo(rightShoulderX, rightShoulderY)
-		gc.ArcTo(rightShoulderX, rightShoulderY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+	logMessage(fmt.Sprintf("[%s] %s", correlationID, strings.SplitN(message, "\n", 2)[0]))
 
-		// left shoulder to right shoulder
-		gc.MoveTo(leftShoulderX, leftShoulderY)
-		gc.LineTo(rightShoulderX, rightShoulderY)
-		gc.Close()
-		gc.FillStroke()
+	if sent := sendMessage(b, chatID, message, bot.OptionsSendMessage{}.SetReplyToMessageID(messageID)); !sent.Ok {
+		logError(fmt.Sprintf("[%s] Failed to send self test result: %s", correlationID, *sent.Description))
+	}
+}
 
-		// left elbow
-		leftElbowX, leftElbowY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexLeftElbow)
-		gc.MoveTo(leftElbowX, leftElbowY)
-		gc.ArcTo(leftElbowX, leftElbowY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+// check if given message is the text command (eg. `/again`)
+func isTextCommand(message *bot.Message, textCommand string) bool {
+	if !message.HasText() || !strings.HasPrefix(*message.Text, "/") {
+		return false
+	}
 
-		// left shoulder to left elbow
-		gc.MoveTo(leftShoulderX, leftShoulderY)
-		gc.LineTo(leftElbowX, leftElbowY)
-		gc.Close()
-		gc.FillStroke()
+	command, _ := parseTextCommand(*message.Text)
+	return command == textCommand
+}
 
-		// right elbow
-		rightElbowX, rightElbowY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexRightElbow)
-		gc.MoveTo(rightElbowX, rightElbowY)
-		gc.ArcTo(rightElbowX, rightElbowY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+// remember the last command of given chat for `/again` (replaced when another command is chosen)
+func rememberLastCommand(chatID int64, command VisionCommand) {
+	updateChatSettings(chatID, func(settings *chatSettings) {
+		settings.LastCommand = command
+	})
+}
 
-		// right shoulder to right elbow
-		gc.MoveTo(rightShoulderX, rightShoulderY)
-		gc.LineTo(rightElbowX, rightElbowY)
-		gc.Close()
-		gc.FillStroke()
+// start processing the image with given file id and command right away
+func processImageWithCommand(b *bot.Bot, chatID int64, messageID int64, from *bot.User, fileID string, command VisionCommand) bool {
+	// for tying logs of this request together
+	correlationID := newCorrelationID()
 
-		// left wrist
-		leftWristX, leftWristY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexLeftWrist)
-		gc.MoveTo(leftWristX, leftWristY)
-		gc.ArcTo(leftWristX, leftWristY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+	if !countDailyRequest(chatID) {
+		logMessage(fmt.Sprintf("[%s] Daily request limit reached, rejecting '%s' for %s", correlationID, command, usernameOf(from)))
 
-		// left elbow to left wrist
-		gc.MoveTo(leftElbowX, leftElbowY)
-		gc.LineTo(leftWristX, leftWristY)
-		gc.Close()
-		gc.FillStroke()
+		sendMessage(b, chatID, messageDailyLimitReached, bot.OptionsSendMessage{}.SetReplyToMessageID(messageID))
 
-		// right wrist
-		rightWristX, rightWristY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexRightWrist)
-		gc.MoveTo(rightWristX, rightWristY)
-		gc.ArcTo(rightWristX, rightWristY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+		return false
+	}
 
-		// right elbow to right wrist
-		gc.MoveTo(rightElbowX, rightElbowY)
-		gc.LineTo(rightWristX, rightWristY)
-		gc.Close()
-		gc.FillStroke()
+	if fileURL, err := fileURLForID(b, fileID); err == nil {
+		// where it will be in the queue
+		position := queuePosition()
+
+		// send a status message (will be deleted after processing)
+		sent := sendMessage(
+			b,
+			chatID,
+			processingMessage(command, position),
+			bot.OptionsSendMessage{}.SetReplyToMessageID(messageID),
+		)
+		if sent.Ok {
+			// log request
+			username := usernameOf(from)
+
+			if !enqueueImageJob(imageJob{
+				correlationID:     correlationID,
+				username:          username,
+				chatID:            chatID,
+				messageIDToDelete: sent.Result.MessageID,
+				fileID:            fileID,
+				fileURL:           fileURL,
+				command:           command,
+				forwardedFrom:     attributionFor(fileID),
+				replyToMessageID:  messageID,
+				languageCode:      languageCodeOf(from),
+				queuePosition:     position,
+			}) {
+				uncountDailyRequest(chatID)
+
+				logError(fmt.Sprintf("[%s] Job queue is full, rejecting '%s' for %s", correlationID, command, username))
+
+				b.EditMessageText(messageBusy, bot.OptionsEditMessageText{}.SetIDs(chatID, sent.Result.MessageID))
+
+				return false
+			}
 
-		// left hip
-		leftHipX, leftHipY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexLeftHip)
-		gc.MoveTo(leftHipX, leftHipY)
-		gc.ArcTo(leftHipX, leftHipY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+			logMessage(fmt.Sprintf("[%s] Processing '%s' for %s", correlationID, command, username))
+			logRequest(correlationID, username, fileURL, command)
 
-		// right hip
-		rightHipX, rightHipY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexRightHip)
-		gc.MoveTo(rightHipX, rightHipY)
-		gc.ArcTo(rightHipX, rightHipY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+			rememberLastCommand(chatID, command)
 
-		// left hip to right hip
-		gc.MoveTo(leftHipX, leftHipY)
-		gc.LineTo(rightHipX, rightHipY)
-		gc.Close()
-		gc.FillStroke()
+			return true
+		}
 
-		// left shoulder to right hip
-		gc.MoveTo(leftShoulderX, leftShoulderY)
-		gc.LineTo(rightHipX, rightHipY)
-		gc.Close()
-		gc.FillStroke()
+		logError(fmt.Sprintf("[%s] Failed to send message: %s", correlationID, *sent.Description))
+	} else {
+		logError(fmt.Sprintf("[%s] Failed to get file from url: %s", correlationID, err))
 
-		// right shoulder to left hip
-		gc.MoveTo(rightShoulderX, rightShoulderY)
-		gc.LineTo(leftHipX, leftHipY)
-		gc.Close()
-		gc.FillStroke()
+		sendMessage(b, chatID, failedToGetFileMessage(err), bot.OptionsSendMessage{}.SetReplyToMessageID(messageID))
+	}
 
-		// left knee
-		leftKneeX, leftKneeY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexLeftKnee)
-		gc.MoveTo(leftKneeX, leftKneeY)
-		gc.ArcTo(leftKneeX, leftKneeY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+	return false
+}
 
-		// left hip to left knee
-		gc.MoveTo(leftHipX, leftHipY)
-		gc.LineTo(leftKneeX, leftKneeY)
-		gc.Close()
-		gc.FillStroke()
+// message for the user when getting a file failed with given error
+func failedToGetFileMessage(err error) string {
+	if err == errFileTooLargeToDownload {
+		return messageFileTooLarge
+	}
+	return messageFailedToGetFile
+}
 
-		// right knee
-		rightKneeX, rightKneeY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexRightKnee)
-		gc.MoveTo(rightKneeX, rightKneeY)
-		gc.ArcTo(rightKneeX, rightKneeY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+// attribution of a forwarded message (empty if it is not forwarded)
+func forwardAttribution(message *bot.Message) string {
+	if message.ForwardFrom != nil {
+		if message.ForwardFrom.Username != nil {
+			return "@" + *message.ForwardFrom.Username
+		}
+		return message.ForwardFrom.FirstName
+	} else if message.ForwardFromChat != nil {
+		if message.ForwardFromChat.Username != nil {
+			return "@" + *message.ForwardFromChat.Username
+		} else if message.ForwardFromChat.Title != nil {
+			return *message.ForwardFromChat.Title
+		}
+		return "a chat"
+	} else if message.ForwardSenderName != nil { // users who hide their accounts
+		return *message.ForwardSenderName
+	}
 
-		// right hip to right knee
-		gc.MoveTo(rightHipX, rightHipY)
-		gc.LineTo(rightKneeX, rightKneeY)
-		gc.Close()
-		gc.FillStroke()
+	return ""
+}
 
-		// left ankle
-		leftAnkleX, leftAnkleY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexLeftAnkle)
-		gc.MoveTo(leftAnkleX, leftAnkleY)
-		gc.ArcTo(leftAnkleX, leftAnkleY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+// attribution of the forwarded image with given file id (empty if it was not forwarded)
+func attributionFor(fileID string) string {
+	fileAttributionsLock.RLock()
+	defer fileAttributionsLock.RUnlock()
 
-		// left knee to left ankle
-		gc.MoveTo(leftKneeX, leftKneeY)
-		gc.LineTo(leftAnkleX, leftAnkleY)
-		gc.Close()
-		gc.FillStroke()
+	return fileAttributions[fileID]
+}
 
-		// right ankle
-		rightAnkleX, rightAnkleY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexRightAnkle)
-		gc.MoveTo(rightAnkleX, rightAnkleY)
-		gc.ArcTo(rightAnkleX, rightAnkleY, PosePointRadius, PosePointRadius, 0, -math.Pi*2)
-		gc.Close()
-		gc.FillStroke()
+// data for rendering caption templates
+type captionTemplateData struct {
+	Command       VisionCommand
+	Count         int      // number of detected things (faces, products, tags, ...)
+	Classes       []string // classes of detected products or tags
+	ForwardedFrom string
+}
 
-		// right knee to right ankle
-		gc.MoveTo(rightKneeX, rightKneeY)
-		gc.LineTo(rightAnkleX, rightAnkleY)
-		gc.Close()
-		gc.FillStroke()
+// title of result captions and messages
+//
+// (rendered with the configured template of the command, if any)
+func resultTitle(command VisionCommand, languageCode, forwardedFrom string, count int, classes []string) string {
+	if tmpl, exists := captionTemplates[command]; exists {
+		buf := new(bytes.Buffer)
+		if err := tmpl.Execute(buf, captionTemplateData{
+			Command:       command,
+			Count:         count,
+			Classes:       classes,
+			ForwardedFrom: forwardedFrom,
+		}); err == nil {
+			return buf.String()
+		} else {
+			logError(fmt.Sprintf("Failed to render caption template of '%s': %s", command, err))
+		}
 	}
 
-	gc.Save()
+	name := localizedCommand(languageCode, command)
+	if titles, exists := localizedResultTitles[languageCode]; exists {
+		if forwardedFrom != "" {
+			return fmt.Sprintf(titles.forwarded, name, forwardedFrom)
+		}
+		return fmt.Sprintf(titles.title, name)
+	}
 
-	return newImg
+	if forwardedFrom != "" {
+		return fmt.Sprintf("Process result of '%s' (forwarded from %s)", name, forwardedFrom)
+	}
+
+	return fmt.Sprintf("Process result of '%s'", name)
 }
 
-// process requested image processing
-func processImage(b *bot.Bot, chatID int64, messageIDToDelete int64, fileURL string, command VisionCommand) {
-	errorMessage := ""
+// localized name of given command, or the command itself if there is no translation
+func localizedCommand(languageCode string, command VisionCommand) string {
+	if name, exists := localizedCmds[languageCode][command]; exists {
+		return name
+	}
+	return string(command)
+}
 
-	// 'typing...'
-	b.SendChatAction(chatID, bot.ChatActionTyping)
+// (primary) language code of given user, eg. "ko" for "ko-KR"
+func languageCodeOf(user *bot.User) string {
+	if user == nil || user.LanguageCode == nil {
+		return ""
+	}
+	return strings.ToLower(strings.SplitN(*user.LanguageCode, "-", 2)[0])
+}
 
-	var imgBytes []byte
-	var err error
+// username (or first name) of given user
+func usernameOf(user *bot.User) string {
+	if user == nil {
+		return ""
+	}
+	if user.Username == nil {
+		return user.FirstName
+	}
+	return *user.Username
+}
 
-	// read image file from url
-	if imgBytes, err = readBytes(fileURL); err == nil {
-		switch command {
-		case DetectFaces, MaskFaces:
-			var detected kakaoapi.ResponseDetectedFace
-			detected, err = kakaoClient.DetectFaceFromBytes(imgBytes, 0.7)
-			if err == nil {
-				if len(detected.Result.Faces) > 0 {
-					var img image.Image
-					imgReader := bytes.NewReader(imgBytes)
-					img, _, err = image.Decode(imgReader)
-					if err == nil {
-						// process image
-						newImg := processImageForFaces(img, detected, command)
+// load per-chat settings from the file
+func loadChats() error {
+	chatsLock.Lock()
+	defer chatsLock.Unlock()
 
-						// 'uploading photo...'
-						b.SendChatAction(chatID, bot.ChatActionUploadPhoto)
+	bytes, err := ioutil.ReadFile(chatsFilepath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // not saved yet
+		}
+		return err
+	}
 
-						// send a photo with rectangles drawn on detected faces
-						buf := new(bytes.Buffer)
-						err = jpeg.Encode(buf, newImg, nil)
-						if err == nil {
-							if sent := b.SendPhoto(
-								chatID,
-								bot.InputFileFromBytes(buf.Bytes()),
-								bot.OptionsSendPhoto{}.SetCaption(fmt.Sprintf("Process result of '%s'", command)),
-							); !sent.Ok {
-								errorMessage = fmt.Sprintf("Failed to send image: %s", *sent.Description)
-							}
-						} else {
-							errorMessage = fmt.Sprintf("Failed to encode image: %s", err)
-						}
-					} else {
-						errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
-					}
-				} else {
-					errorMessage = "No face detected on this image."
-				}
-			} else {
-				errorMessage = fmt.Sprintf("Failed to detect faces: %s", err)
-			}
-		case DetectProducts:
-			var detected kakaoapi.ResponseDetectedProduct
-			detected, err = kakaoClient.DetectProductFromBytes(imgBytes, 0.7)
-			if err == nil {
-				if len(detected.Result.Objects) > 0 {
-					var img image.Image
-					imgReader := bytes.NewReader(imgBytes)
-					img, _, err = image.Decode(imgReader)
-					if err == nil {
-						newImg, classes := processImageForProducts(img, detected)
+	return json.Unmarshal(bytes, &chats)
+}
 
-						// 'uploading photo...'
-						b.SendChatAction(chatID, bot.ChatActionUploadPhoto)
+// save per-chat settings to the file
+//
+// (should be called while holding `chatsLock`)
+func saveChats() error {
+	bytes, err := json.MarshalIndent(chats, "", "  ")
+	if err != nil {
+		return err
+	}
 
-						// send a photo with rectangles drawn on detected faces
-						buf := new(bytes.Buffer)
-						err = jpeg.Encode(buf, newImg, nil)
-						if err == nil {
-							if sent := b.SendPhoto(
-								chatID,
-								bot.InputFileFromBytes(buf.Bytes()),
-								bot.OptionsSendPhoto{}.SetCaption(fmt.Sprintf("Process result of '%s':\n\n%s", command, strings.Join(classes, "\n"))),
-							); !sent.Ok {
-								errorMessage = fmt.Sprintf("Failed to send image: %s", *sent.Description)
-							}
-						} else {
-							errorMessage = fmt.Sprintf("Failed to encode image: %s", err)
-						}
-					} else {
-						errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
-					}
-				} else {
-					errorMessage = "No product detected on this image."
-				}
-			}
+	// write to a temporary file first, then replace the original one
+	tmpFilepath := chatsFilepath + ".tmp"
+	if err := ioutil.WriteFile(tmpFilepath, bytes, 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFilepath, chatsFilepath)
+}
+
+// settings of given chat
+func chatSettingsFor(chatID int64) chatSettings {
+	chatsLock.RLock()
+	defer chatsLock.RUnlock()
+
+	return chats[chatID]
+}
+
+// update settings of given chat and persist them
+func updateChatSettings(chatID int64, update func(settings *chatSettings)) {
+	chatsLock.Lock()
+	defer chatsLock.Unlock()
+
+	settings := chats[chatID]
+	update(&settings)
+	chats[chatID] = settings
+
+	if err := saveChats(); err != nil {
+		logError(fmt.Sprintf("Failed to save chat settings to %s: %s", chatsFilepath, err))
+	}
+}
+
+// count a request of given chat for today (returns false if the daily limit is already reached)
+func countDailyRequest(chatID int64) (counted bool) {
+	if conf.DailyRequestLimitPerChat <= 0 {
+		return true
+	}
+
+	today := time.Now().Format("2006-01-02")
+	updateChatSettings(chatID, func(settings *chatSettings) {
+		// reset the counter on a new day
+		if settings.RequestsDate != today {
+			settings.RequestsDate = today
+			settings.RequestsCount = 0
+		}
+
+		if settings.RequestsCount < conf.DailyRequestLimitPerChat {
+			settings.RequestsCount++
+			counted = true
+		}
+	})
+
+	return counted
+}
+
+// uncount a counted request of given chat (eg. when it was not processed at all)
+func uncountDailyRequest(chatID int64) {
+	if conf.DailyRequestLimitPerChat <= 0 {
+		return
+	}
+
+	updateChatSettings(chatID, func(settings *chatSettings) {
+		if settings.RequestsCount > 0 {
+			settings.RequestsCount--
+		}
+	})
+}
+
+// process incoming callback query
+func processCallbackQuery(b *bot.Bot, update bot.Update) (result bool) {
+	// process result
+	result = false
+
+	var username string
+	message := ""
+	var keyboard [][]bot.InlineKeyboardButton // for asking a follow-up choice
+	enqueued := false                         // message is owned by the worker when enqueued
+	query := *update.CallbackQuery
+	data := *query.Data
+
+	// for tying logs of this request together
+	correlationID := newCorrelationID()
+
+	// navigating pages of a paginated text (`page/TOKEN/INDEX`)
+	if strings.HasPrefix(data, commandPage+"/") {
+		return processPageCallbackQuery(b, query, correlationID)
+	}
+
+	if data == commandCancel {
+		clearPendingStep(query.From.ID)
+
+		message = messageCanceled
+	} else {
+		parsedCommand := strings.Split(data, "/")
+
+		// retrying a failed command (`retry/COMMAND/SHORTENED_FILE_ID[/STYLE]`)
+		isRetry := len(parsedCommand) > 0 && parsedCommand[0] == commandRetry
+		if isRetry {
+			parsedCommand = parsedCommand[1:]
+		}
+
+		if len(parsedCommand) >= 2 {
+			command := parsedCommand[0]
+			shortenedFileID := parsedCommand[1]
+
+			fileIDsLock.RLock()
+			fileID, exists := fileIDs[shortenedFileID]
+			fileIDsLock.RUnlock()
+
+			if exists {
+				if fileURL, err := fileURLForID(b, fileID); err == nil {
+					if isRetry || strings.Contains(*query.Message.Text, "image") {
+						visionCommand := visionCommandForCommand(command)
+
+						username = usernameOf(&query.From)
+
+						if !isCommandAllowed(query.Message.Chat.ID, visionCommand) {
+							logMessage(fmt.Sprintf("[%s] Admin-only command '%s' was requested by %s", correlationID, visionCommand, username))
+
+							message = messageNotAllowed
+						} else if visionCommand == MaskFaces && len(parsedCommand) < 3 {
+							// ask masking style first
+							message = messageChooseMaskStyle
+							keyboard = genMaskStyleInlineKeyboards(command, shortenedFileID)
+						} else if !countDailyRequest(query.Message.Chat.ID) {
+							logMessage(fmt.Sprintf("[%s] Daily request limit reached, rejecting '%s' for %s", correlationID, visionCommand, username))
+
+							message = messageDailyLimitReached
+						} else {
+							position := queuePosition()
+
+							// tell where it will be in the queue (and remove inline keyboards) before enqueueing
+							b.EditMessageText(processingMessage(visionCommand, position), bot.OptionsEditMessageText{}.SetIDs(query.Message.Chat.ID, query.Message.MessageID))
+
+							if enqueueImageJob(imageJob{
+								correlationID:     correlationID,
+								username:          username,
+								chatID:            query.Message.Chat.ID,
+								messageIDToDelete: query.Message.MessageID,
+								fileID:            fileID,
+								fileURL:           fileURL,
+								command:           visionCommand,
+								forwardedFrom:     attributionFor(fileID),
+								replyToMessageID:  originalMessageID(query.Message),
+								maskStyle:         maskStyleOf(parsedCommand),
+								languageCode:      languageCodeOf(&query.From),
+								queuePosition:     position,
+							}) {
+								enqueued = true
+
+								// log request
+								logMessage(fmt.Sprintf("[%s] Processing '%s' for %s", correlationID, visionCommand, username))
+								logRequest(correlationID, username, fileURL, visionCommand)
+
+								rememberLastCommand(query.Message.Chat.ID, visionCommand)
+							} else {
+								uncountDailyRequest(query.Message.Chat.ID)
+
+								logError(fmt.Sprintf("[%s] Job queue is full, rejecting '%s' for %s", correlationID, visionCommand, username))
+
+								message = messageBusy
+							}
+						}
+					} else {
+						message = messageUnprocessable
+					}
+				} else {
+					logError(fmt.Sprintf("[%s] Failed to get file from url: %s", correlationID, err))
+
+					message = failedToGetFileMessage(err)
+				}
+			} else {
+				logError(fmt.Sprintf("[%s] Failed to get file id from shortened file id: `%s`, maybe bot was restarted?", correlationID, shortenedFileID))
+
+				message = messageFailedToGetFile
+			}
+		} else {
+			logError(fmt.Sprintf("[%s] Failed to parse command: %s", correlationID, data))
+
+			message = messageUnprocessable
+		}
+	}
+
+	// answer callback query
+	if apiResult := b.AnswerCallbackQuery(query.ID, nil); apiResult.Ok && enqueued {
+		// already edited, and now owned by the worker
+		result = true
+	} else if apiResult.Ok {
+		// edit message and remove inline keyboards (or replace them with ones for the follow-up choice)
+		options := bot.OptionsEditMessageText{}.SetIDs(query.Message.Chat.ID, query.Message.MessageID)
+		if keyboard != nil {
+			options.SetReplyMarkup(bot.InlineKeyboardMarkup{
+				InlineKeyboard: keyboard,
+			})
+		}
+		if apiResult := b.EditMessageText(message, options); apiResult.Ok {
+			result = true
+		} else {
+			logError(fmt.Sprintf("[%s] Failed to edit message text: %s", correlationID, *apiResult.Description))
+		}
+	} else {
+		logError(fmt.Sprintf("[%s] Failed to answer callback query: %+v", correlationID, query))
+	}
+
+	return result
+}
+
+// content type of given bytes, sniffed from their magic numbers (eg. "image/png", "application/pdf")
+func sniffContentType(data []byte) string {
+	// not sniffed by `http.DetectContentType`
+	if bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*")) {
+		return "image/tiff"
+	}
+
+	return strings.SplitN(http.DetectContentType(data), ";", 2)[0]
+}
+
+// error for downloaded content which is not an image
+type errNotAnImage struct {
+	contentType string
+}
+
+func (e errNotAnImage) Error() string {
+	return fmt.Sprintf("not an image (%s)", e.contentType)
+}
+
+// error for a pdf document whose image could not be extracted
+type errUnreadablePDF struct {
+	err error
+}
+
+func (e errUnreadablePDF) Error() string {
+	return fmt.Sprintf("unreadable pdf (%s)", e.err)
+}
+
+// alternate decoders for images which fail to be decoded with `image.Decode`
+var alternateDecoders = []struct {
+	name   string
+	decode func(imgBytes []byte) (image.Image, error)
+}{
+	{"jpeg (repaired)", decodeRepairedJPEG},
+}
+
+// decode given image bytes, falling back to alternate decoders on failure
+func decodeImage(correlationID string, imgBytes []byte) (img image.Image, err error) {
+	if img, _, err = image.Decode(bytes.NewReader(imgBytes)); err == nil {
+		return img, nil
+	}
+
+	for _, decoder := range alternateDecoders {
+		if decoded, decodeErr := decoder.decode(imgBytes); decodeErr == nil {
+			logMessage(fmt.Sprintf("[%s] Decoded image with alternate decoder: %s (standard decoder failed with: %s)", correlationID, decoder.name, err))
+
+			return decoded, nil
+		}
+	}
+
+	return nil, err
+}
+
+// decode jpeg bytes after trimming garbage around SOI/EOI markers (or appending a missing EOI marker)
+//
+// (some phones and editors prepend/append extra data or truncate the last marker)
+func decodeRepairedJPEG(imgBytes []byte) (image.Image, error) {
+	soi, eoi := []byte{0xff, 0xd8}, []byte{0xff, 0xd9}
+
+	start := bytes.Index(imgBytes, soi)
+	if start < 0 {
+		return nil, fmt.Errorf("no SOI marker")
+	}
+	repaired := imgBytes[start:]
+
+	if end := bytes.LastIndex(repaired, eoi); end >= 0 {
+		repaired = repaired[:end+len(eoi)]
+	} else {
+		repaired = append(append([]byte{}, repaired...), eoi...)
+	}
+
+	return jpeg.Decode(bytes.NewReader(repaired))
+}
+
+// reactions to original image messages
+//
+// (✅ and ❌ are not in the list of available reactions, so thumbs are used instead)
+const (
+	reactionSucceeded = "👍"
+	reactionFailed    = "👎"
+)
+
+// set a reaction with given emoji on given message
+//
+// (the bot library doesn't support `setMessageReaction` yet, so call it directly)
+func setMessageReaction(chatID, messageID int64, emoji string) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"chat_id":    chatID,
+		"message_id": messageID,
+		"reaction": []map[string]string{
+			{"type": "emoji", "emoji": emoji},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	baseURL := botAPIBaseURL
+	if conf.BotAPIBaseURL != "" {
+		baseURL = strings.TrimSuffix(conf.BotAPIBaseURL, "/")
+	}
+
+	response, err := botAPIHTTPClient.Post(fmt.Sprintf("%s/bot%s/setMessageReaction", baseURL, conf.TelegramAPIToken), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var result struct {
+		Ok          bool   `json:"ok"`
+		Description string `json:"description,omitempty"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode response (HTTP status %d): %s", response.StatusCode, err)
+	}
+	if !result.Ok {
+		return fmt.Errorf("%s", result.Description)
+	}
+
+	return nil
+}
+
+// url of given file for downloading
+//
+// (from the self-hosted bot api server if `bot-api-base-url` is set)
+func fileURLFor(b *bot.Bot, file bot.File) (string, error) {
+	if conf.BotAPIBaseURL == "" || file.FilePath == nil {
+		return b.GetFileURL(file), nil
+	}
+
+	// local bot api server (in `--local` mode) returns absolute paths of files
+	if filepath.IsAbs(*file.FilePath) {
+		path, err := botAPIFilePath(*file.FilePath)
+		if err != nil {
+			return "", err
+		}
+		return localFileURLPrefix + path, nil
+	}
+
+	return fmt.Sprintf("%s/file/bot%s/%s", strings.TrimSuffix(conf.BotAPIBaseURL, "/"), conf.TelegramAPIToken, *file.FilePath), nil
+}
+
+// prefix of urls of files in `bot-api-files-dir`
+const localFileURLPrefix = "file://"
+
+// check if given absolute path (with symbolic links evaluated) is in `bot-api-files-dir`, and return it
+//
+// (for not reading any other local files)
+func botAPIFilePath(path string) (string, error) {
+	if conf.BotAPIFilesDir == "" {
+		return "", fmt.Errorf("bot-api-files-dir is not set for reading local file: %s", path)
+	}
+
+	dir, err := filepath.Abs(conf.BotAPIFilesDir)
+	if err == nil {
+		dir, err = filepath.EvalSymlinks(dir)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve bot-api-files-dir: %s", err)
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return "", err
+	}
+
+	if rel, err := filepath.Rel(dir, path); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file is not in bot-api-files-dir: %s", path)
+	}
+
+	return path, nil
+}
+
+// url of the file with given id
+//
+// (images received as data URIs are kept in memory, so their ids are returned as they are)
+func fileURLForID(b *bot.Bot, fileID string) (string, error) {
+	if strings.HasPrefix(fileID, dataURIFileIDPrefix) {
+		if _, exists := storedImageBytes(fileID); !exists {
+			return "", fmt.Errorf("no stored image for %s, maybe bot was restarted?", fileID)
+		}
+		return fileID, nil
+	}
+
+	fileResult := b.GetFile(fileID)
+	if !fileResult.Ok {
+		if strings.Contains(*fileResult.Description, "file is too big") {
+			return "", errFileTooLargeToDownload
+		}
+		return "", fmt.Errorf("%s", *fileResult.Description)
+	}
+
+	// skip the download which will fail anyway (local bot api servers have no such limit)
+	if conf.BotAPIBaseURL == "" && fileResult.Result.FileSize > telegramMaxDownloadBytes {
+		return "", errFileTooLargeToDownload
+	}
+
+	return fileURLFor(b, *fileResult.Result)
+}
+
+// error for a file larger than the download limit of the public bot api
+var errFileTooLargeToDownload = fmt.Errorf("file exceeds telegram download limit (%d bytes)", telegramMaxDownloadBytes)
+
+// texts split into pages, viewed with prev/next buttons
+type paginatedText struct {
+	header   string // shown on every page
+	pages    []string
+	markdown bool // header and pages are in markdown v2
+}
+
+// paginated texts sent (key: token)
+var paginatedTexts = map[string]paginatedText{}
+var paginatedTextTokens []string // in the order of being sent, for evicting old ones
+var paginatedTextsLock sync.Mutex
+
+// split given items into pages of `TextPageLength` characters at most (an item is never split)
+func paginate(items []string, separator string) (pages []string) {
+	page, length := []string{}, 0
+	for _, item := range items {
+		itemLength := utf8.RuneCountInString(item)
+		if len(page) > 0 && length+utf8.RuneCountInString(separator)+itemLength > TextPageLength {
+			pages = append(pages, strings.Join(page, separator))
+			page, length = []string{}, 0
+		}
+		if len(page) > 0 {
+			length += utf8.RuneCountInString(separator)
+		}
+		page = append(page, item)
+		length += itemLength
+	}
+	if len(page) > 0 {
+		pages = append(pages, strings.Join(page, separator))
+	}
+
+	return pages
+}
+
+// text of the page at given index
+func (p paginatedText) pageText(index int) string {
+	texts := []string{}
+	if p.header != "" {
+		texts = append(texts, p.header)
+	}
+	texts = append(texts, p.pages[index])
+	if len(p.pages) > 1 {
+		page := fmt.Sprintf(messagePage, index+1, len(p.pages))
+		if p.markdown {
+			page = escapeMarkdownV2(page)
+		}
+		texts = append(texts, page)
+	}
+
+	return strings.Join(texts, "\n\n")
+}
+
+// generate inline keyboards for navigating to the previous/next pages of given index
+//
+// (callback data: `page/TOKEN/INDEX`)
+func genPageInlineKeyboards(token string, index, numPages int) [][]bot.InlineKeyboardButton {
+	buttons := []bot.InlineKeyboardButton{}
+	if index > 0 {
+		prev := fmt.Sprintf("%s/%s/%d", commandPage, token, index-1)
+		buttons = append(buttons, bot.InlineKeyboardButton{Text: messagePrevPage, CallbackData: &prev})
+	}
+	if index < numPages-1 {
+		next := fmt.Sprintf("%s/%s/%d", commandPage, token, index+1)
+		buttons = append(buttons, bot.InlineKeyboardButton{Text: messageNextPage, CallbackData: &next})
+	}
+
+	return [][]bot.InlineKeyboardButton{buttons}
+}
+
+// send given items as a message, or as the first page of paginated ones (with prev/next buttons) when they are too long
+func sendPaginatedTexts(b *bot.Bot, chatID int64, header string, items []string, separator string, markdown bool, options bot.OptionsSendMessage) bot.APIResponseMessage {
+	paginated := paginatedText{header: header, pages: paginate(items, separator), markdown: markdown}
+	if len(paginated.pages) == 0 {
+		paginated.pages = []string{""}
+	}
+	if markdown {
+		options.SetParseMode(bot.ParseModeMarkdownV2)
+	}
+	if len(paginated.pages) == 1 {
+		return sendMessage(b, chatID, paginated.pageText(0), options)
+	}
+
+	token := newCorrelationID()
+
+	paginatedTextsLock.Lock()
+	paginatedTexts[token] = paginated
+	paginatedTextTokens = append(paginatedTextTokens, token)
+
+	// evict the oldest ones
+	for len(paginatedTextTokens) > MaxPaginatedTexts {
+		delete(paginatedTexts, paginatedTextTokens[0])
+		paginatedTextTokens = paginatedTextTokens[1:]
+	}
+	paginatedTextsLock.Unlock()
+
+	return sendMessage(b, chatID, paginated.pageText(0), options.SetReplyMarkup(bot.InlineKeyboardMarkup{
+		InlineKeyboard: genPageInlineKeyboards(token, 0, len(paginated.pages)),
+	}))
+}
+
+// process callback query for navigating pages of a paginated text
+func processPageCallbackQuery(b *bot.Bot, query bot.CallbackQuery, correlationID string) (result bool) {
+	var paginated paginatedText
+	var index int
+	parsed := strings.Split(*query.Data, "/")
+	exists := false
+	if len(parsed) == 3 {
+		paginatedTextsLock.Lock()
+		paginated, exists = paginatedTexts[parsed[1]]
+		paginatedTextsLock.Unlock()
+
+		var err error
+		if index, err = strconv.Atoi(parsed[2]); err != nil || index < 0 || index >= len(paginated.pages) {
+			exists = false
+		}
+	}
+
+	if !exists {
+		logError(fmt.Sprintf("[%s] Failed to get paginated text for: %s, maybe bot was restarted?", correlationID, *query.Data))
+
+		b.AnswerCallbackQuery(query.ID, bot.OptionsAnswerCallbackQuery{"text": messagePageExpired})
+		return false
+	}
+
+	if apiResult := b.AnswerCallbackQuery(query.ID, nil); !apiResult.Ok {
+		logError(fmt.Sprintf("[%s] Failed to answer callback query: %+v", correlationID, query))
+		return false
+	}
+
+	options := bot.OptionsEditMessageText{}.
+		SetIDs(query.Message.Chat.ID, query.Message.MessageID).
+		SetReplyMarkup(bot.InlineKeyboardMarkup{
+			InlineKeyboard: genPageInlineKeyboards(parsed[1], index, len(paginated.pages)),
+		})
+	if paginated.markdown {
+		options.SetParseMode(bot.ParseModeMarkdownV2)
+	}
+	if apiResult := b.EditMessageText(paginated.pageText(index), options); apiResult.Ok {
+		result = true
+	} else {
+		logError(fmt.Sprintf("[%s] Failed to edit message text: %s", correlationID, *apiResult.Description))
+	}
+
+	return result
+}
+
+// labeling poll of a detected product
+type labelingPoll struct {
+	correlationID string
+	index         int    // index of the product (starting from 1)
+	detected      string // detected class
+}
+
+// labeling polls sent (key: poll id)
+var labelingPolls = map[string]labelingPoll{}
+var labelingPollIDs []string // in the order of being sent, for evicting old ones
+var labelingPollsLock sync.Mutex
+
+// send polls asking what each of detected products is, with the detected class and other detected classes as options
+func sendLabelingPolls(b *bot.Bot, chatID, replyToMessageID int64, correlationID string, detected kakaoapi.ResponseDetectedProduct) {
+	classes := []string{}
+	for _, c := range countProductClasses(detected) {
+		classes = append(classes, c.class)
+	}
+
+	for i, o := range detected.Result.Objects {
+		if i >= MaxLabelingPollsPerImage {
+			break
+		}
+
+		// the detected class first, then others
+		options := []string{o.Class}
+		for _, class := range classes {
+			if len(options) >= MaxLabelingPollOptions {
+				break
+			}
+			if class != o.Class {
+				options = append(options, class)
+			}
+		}
+		options = append(options, messageSomethingElse)
+
+		sent := b.SendPoll(chatID, fmt.Sprintf(messageLabelingPoll, i+1), options, bot.OptionsSendPoll{}.
+			SetIsAnonymous(false).
+			SetReplyToMessageID(replyToMessageID).
+			SetAllowSendingWithoutReply(true))
+		if !sent.Ok {
+			logError(fmt.Sprintf("[%s] Failed to send labeling poll: %s", correlationID, *sent.Description))
+			continue
+		} else if sent.Result.Poll == nil {
+			continue
+		}
+
+		labelingPollsLock.Lock()
+		labelingPolls[sent.Result.Poll.ID] = labelingPoll{correlationID: correlationID, index: i + 1, detected: o.Class}
+		labelingPollIDs = append(labelingPollIDs, sent.Result.Poll.ID)
+
+		// evict the oldest ones
+		for len(labelingPollIDs) > MaxLabelingPolls {
+			delete(labelingPolls, labelingPollIDs[0])
+			labelingPollIDs = labelingPollIDs[1:]
+		}
+		labelingPollsLock.Unlock()
+	}
+}
+
+// log the current state of a labeling poll
+func processPoll(update bot.Update) {
+	poll := update.Poll
+
+	labelingPollsLock.Lock()
+	labeling, exists := labelingPolls[poll.ID]
+	labelingPollsLock.Unlock()
+
+	if !exists {
+		return
+	}
+
+	votes := []string{}
+	for _, option := range poll.Options {
+		votes = append(votes, fmt.Sprintf("%s: %d", option.Text, option.VoterCount))
+	}
+	logMessage(fmt.Sprintf("[%s] Labeling poll of product #%d (detected as '%s'): %s", labeling.correlationID, labeling.index, labeling.detected, strings.Join(votes, ", ")))
+}
+
+// prefix of file ids of images received as data URIs
+const dataURIFileIDPrefix = "datauri-"
+
+// data URI of an image, eg. `data:image/png;base64,iVBORw0KGgo...`
+var dataURIRegexp = regexp.MustCompile(`^data:(image/[\w.+-]+);base64,([A-Za-z0-9+/=\s]+)$`)
+
+// images received as data URIs (key: file id)
+var storedImages = map[string][]byte{}
+var storedImageIDs []string // in the order of being stored, for evicting old ones
+var storedImagesLock sync.RWMutex
+
+// validate and decode given data URI, then keep its image in memory and return its file id
+func storeDataURIImage(dataURI string) (fileID string, err error) {
+	matches := dataURIRegexp.FindStringSubmatch(strings.TrimSpace(dataURI))
+	if matches == nil {
+		return "", fmt.Errorf("not a base64-encoded image")
+	}
+
+	encoded := strings.Join(strings.Fields(matches[2]), "")
+	if base64.StdEncoding.DecodedLen(len(encoded)) > MaxDataURIImageBytes {
+		return "", fmt.Errorf("image is larger than %d bytes", MaxDataURIImageBytes)
+	}
+
+	var decoded []byte
+	if decoded, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+		return "", fmt.Errorf("malformed base64: %s", err)
+	}
+	if _, _, err = image.DecodeConfig(bytes.NewReader(decoded)); err != nil {
+		return "", fmt.Errorf("unsupported %s image: %s", matches[1], err)
+	}
+
+	sum := sha256.Sum256(decoded)
+	fileID = dataURIFileIDPrefix + hex.EncodeToString(sum[:])
+
+	storedImagesLock.Lock()
+	defer storedImagesLock.Unlock()
+
+	if _, exists := storedImages[fileID]; !exists {
+		storedImages[fileID] = decoded
+		storedImageIDs = append(storedImageIDs, fileID)
+
+		// evict the oldest ones
+		for len(storedImageIDs) > MaxStoredImages {
+			delete(storedImages, storedImageIDs[0])
+			storedImageIDs = storedImageIDs[1:]
+		}
+	}
+
+	return fileID, nil
+}
+
+// bytes of the image received as a data URI
+func storedImageBytes(fileID string) (imgBytes []byte, exists bool) {
+	storedImagesLock.RLock()
+	defer storedImagesLock.RUnlock()
+
+	imgBytes, exists = storedImages[fileID]
+	return imgBytes, exists
+}
+
+// downloaded images (key: file id)
+var downloadCache = map[string]cachedDownload{}
+var downloadCacheLock sync.Mutex
+
+// bytes of a downloaded image, kept for `download-cache-ttl-seconds`
+type cachedDownload struct {
+	bytes     []byte
+	expiresAt time.Time
+}
+
+// read bytes of the file with given id from the download cache, or from given url
+//
+// (for not downloading the same image again when running multiple commands on it)
+func readBytesCached(fileID, url string) ([]byte, error) {
+	if conf.DownloadCacheTTLSeconds <= 0 || fileID == "" || strings.HasPrefix(fileID, dataURIFileIDPrefix) {
+		return readBytes(url)
+	}
+
+	now := time.Now()
+
+	downloadCacheLock.Lock()
+	// evict expired ones
+	for id, cached := range downloadCache {
+		if now.After(cached.expiresAt) {
+			delete(downloadCache, id)
+		}
+	}
+	cached, exists := downloadCache[fileID]
+	downloadCacheLock.Unlock()
+
+	if exists {
+		return cached.bytes, nil
+	}
+
+	bytes, err := readBytes(url)
+	if err != nil {
+		return nil, err
+	}
+
+	downloadCacheLock.Lock()
+	downloadCache[fileID] = cachedDownload{
+		bytes:     bytes,
+		expiresAt: now.Add(time.Duration(conf.DownloadCacheTTLSeconds) * time.Second),
+	}
+	downloadCacheLock.Unlock()
+
+	return bytes, nil
+}
+
+// read bytes from given url (or `file://` url of a file in `bot-api-files-dir`, or id of an image received as a data URI)
+func readBytes(url string) (bytes []byte, err error) {
+	if strings.HasPrefix(url, dataURIFileIDPrefix) {
+		if imgBytes, exists := storedImageBytes(url); exists {
+			return imgBytes, nil
+		}
+		return nil, fmt.Errorf("no stored image for %s", url)
+	}
+
+	if strings.HasPrefix(url, localFileURLPrefix) {
+		// (checked again, as it could be changed after the url was made)
+		var path string
+		if path, err = botAPIFilePath(strings.TrimPrefix(url, localFileURLPrefix)); err != nil {
+			return nil, err
+		}
+
+		var info os.FileInfo
+		if info, err = os.Stat(path); err != nil {
+			return nil, err
+		}
+		if info.Size() > conf.MaxDownloadBytes {
+			return nil, errImageTooLarge(info.Size())
+		}
+
+		return ioutil.ReadFile(path)
+	}
+
+	var response *http.Response
+	response, err = http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	if response.ContentLength > conf.MaxDownloadBytes {
+		return nil, errImageTooLarge(response.ContentLength)
+	}
+
+	// read one more byte for checking if it exceeds the limit (Content-Length can be missing or wrong)
+	bytes, err = ioutil.ReadAll(io.LimitReader(response.Body, conf.MaxDownloadBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(bytes)) > conf.MaxDownloadBytes {
+		return nil, errImageTooLarge(-1)
+	}
+
+	return bytes, nil
+}
+
+// error for an image file larger than `max-download-bytes` (size < 0 if unknown)
+func errImageTooLarge(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("image too large (over %d bytes)", conf.MaxDownloadBytes)
+	}
+	return fmt.Errorf("image too large (%d bytes, over %d bytes)", size, conf.MaxDownloadBytes)
+}
+
+func processImageForFaces(img image.Image, detected kakaoapi.ResponseDetectedFace, command VisionCommand, maskStyle string, palette []color.RGBA) image.Image {
+	var err error
+
+	// image's width and height
+	width, height := float64(detected.Result.Width), float64(detected.Result.Height)
+
+	// copy to a new image
+	newImg := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(newImg, newImg.Bounds(), img, image.ZP, draw.Src)
+	gc := draw2dimg.NewGraphicContext(newImg)
+	gc.SetLineWidth(StrokeWidth)
+	gc.SetFillColor(color.Transparent)
+
+	// blur the whole image first (sharp faces will be copied back on it)
+	if command == BlurBackground {
+		sigma := math.Max(float64(newImg.Bounds().Dx()), float64(newImg.Bounds().Dy())) * BackgroundBlurSigmaRatio
+		if sigma < BackgroundBlurSigmaMin {
+			sigma = BackgroundBlurSigmaMin
+		}
+
+		g := gift.New(
+			gift.GaussianBlur(float32(sigma)),
+		)
+		blurred := image.NewRGBA(g.Bounds(newImg.Bounds()))
+		g.Draw(blurred, newImg)
+		draw.Draw(newImg, newImg.Bounds(), blurred, image.ZP, draw.Src)
+	}
+
+	// build up facial attributes string
+	for i, f := range detected.Result.Faces {
+		// skip zero-size faces
+		rect, ok := regionRect(f.X, f.Y, f.X+f.W, f.Y+f.H, width, height, newImg.Bounds())
+		if !ok {
+			continue
+		}
+
+		switch command {
+		case DetectFaces:
+			// prepare freetype font
+			fc := freetype.NewContext()
+			fc.SetFont(font)
+			fc.SetDPI(72)
+			fc.SetClip(newImg.Bounds())
+			fc.SetDst(newImg)
+			fontSize := float64(newImg.Bounds().Dy()) / 24.0
+			fc.SetFontSize(fontSize)
+
+			// set color
+			color := colorForIndex(palette, i)
+			if conf.GenderColoring {
+				color = genderColors[genderOf(f.FacialAttributes.Gender.Male, f.FacialAttributes.Gender.Female)]
+			}
+			gc.SetStrokeColor(color)
+			fc.SetSrc(&image.Uniform{labelColor(color)})
+
+			// draw rectangles and their indices on detected faces
+			drawBox(gc, width*f.X, height*f.Y, width*(f.X+f.W), height*(f.Y+f.H))
+
+			// draw face label
+			if conf.LabelStyle == labelStyleBadge {
+				drawBadge(newImg, fmt.Sprintf("%d", i+1), color, width*f.X, height*f.Y, width*(f.X+f.W), height*(f.Y+f.H))
+			} else {
+				if _, err = fc.DrawString(
+					fmt.Sprintf("Face #%d", i+1),
+					freetype.Pt(
+						int(width*f.X+5),
+						int(fc.PointToFixed(height*(f.Y+f.H)-5)>>6),
+					),
+				); err != nil {
+					logError(fmt.Sprintf("Failed to draw string: %s", err))
+				}
+			}
+
+			// mark nose
+			nosePoints := f.FacialPoints.Nose
+			for _, n := range nosePoints {
+				gc.MoveTo(width*n.X(), height*n.Y())
+				gc.ArcTo(width*n.X(), height*n.Y(), CircleRadius, CircleRadius, 0, -math.Pi*2)
+				gc.Close()
+				gc.FillStroke()
+			}
+
+			// mark right eye
+			rightEyePoints := f.FacialPoints.RightEye
+			for _, r := range rightEyePoints {
+				gc.MoveTo(width*r.X(), height*r.Y())
+				gc.ArcTo(width*r.X(), height*r.Y(), CircleRadius, CircleRadius, 0, -math.Pi*2)
+				gc.Close()
+				gc.FillStroke()
+			}
+
+			// mark left pupil
+			leftEyePoints := f.FacialPoints.LeftEye
+			for _, l := range leftEyePoints {
+				gc.MoveTo(width*l.X(), height*l.Y())
+				gc.ArcTo(width*l.X(), height*l.Y(), CircleRadius, CircleRadius, 0, -math.Pi*2)
+				gc.Close()
+				gc.FillStroke()
+			}
+
+			// mark lips
+			lipPoints := f.FacialPoints.Lip
+			for _, l := range lipPoints {
+				gc.MoveTo(width*l.X(), height*l.Y())
+				gc.ArcTo(width*l.X(), height*l.Y(), CircleRadius, CircleRadius, 0, -math.Pi*2)
+				gc.Close()
+				gc.FillStroke()
+			}
+
+			// connect facial points into outlines
+			if conf.ConnectFacialPoints {
+				drawPolyline(gc, f.FacialPoints.Nose, width, height, false)
+				drawPolyline(gc, f.FacialPoints.RightEye, width, height, true)
+				drawPolyline(gc, f.FacialPoints.LeftEye, width, height, true)
+				drawPolyline(gc, f.FacialPoints.Lip, width, height, true)
+			}
+		case EmojiFaces:
+			// overlay emoji on face rects
+			g := gift.New(
+				gift.Resize(rect.Dx(), rect.Dy(), gift.LanczosResampling),
+			)
+			resized := image.NewRGBA(g.Bounds(emoji.Bounds()))
+			g.Draw(resized, emoji)
+			draw.Draw(newImg, rect, resized, image.ZP, draw.Over)
+		case MaskFaces:
+			// mask face rects
+			switch maskStyle {
+			case maskStyleBlur:
+				blur(newImg, rect, float32(pixelateBlockSize(width*f.W)))
+			case maskStyleBlackbox:
+				draw.Draw(newImg, rect, &image.Uniform{color.Black}, image.ZP, draw.Src)
+			default:
+				pixelate(newImg, rect, pixelateBlockSize(width*f.W))
+			}
+		case BlurBackground:
+			// copy sharp face rects from the original image
+			draw.Draw(newImg, rect, img, rect.Min.Add(img.Bounds().Min), draw.Src)
+		}
+	}
+	gc.Save()
+
+	// draw legend of gender colors
+	if command == DetectFaces && conf.GenderColoring {
+		drawLegend(newImg, []string{"male", "female", "unknown"}, []color.RGBA{genderColors["male"], genderColors["female"], genderColors["unknown"]})
+	}
+
+	return newImg
+}
+
+// block size for pixelating a face with given width
+func pixelateBlockSize(faceWidth float64) int {
+	divisor := conf.PixelateDivisor
+	if divisor <= 0 {
+		divisor = DefaultPixelateDivisor
+	}
+
+	blockSize := int(faceWidth / float64(divisor))
+	if blockSize < MinPixelateBlockSize {
+		blockSize = MinPixelateBlockSize
+	}
+
+	return blockSize
+}
+
+// pixelate given rect of an image with given block size
+func pixelate(img *image.RGBA, rect image.Rectangle, blockSize int) {
+	g := gift.New(
+		gift.Pixelate(blockSize),
+	)
+	g.DrawAt(
+		img,
+		img.SubImage(rect),
+		rect.Min,
+		gift.CopyOperator,
+	)
+}
+
+// blur given rect of an image with given sigma
+func blur(img *image.RGBA, rect image.Rectangle, sigma float32) {
+	g := gift.New(
+		gift.GaussianBlur(sigma),
+	)
+	g.DrawAt(
+		img,
+		img.SubImage(rect),
+		rect.Min,
+		gift.CopyOperator,
+	)
+}
+
+// generate an animation which transitions from the original image to the face-masked one
+func maskRevealAnimation(img image.Image, detected kakaoapi.ResponseDetectedFace) *gif.GIF {
+	// scale down for keeping the animation small
+	g := gift.New(gift.ResizeToFit(MaskRevealMaxSize, MaskRevealMaxSize, gift.LinearResampling))
+	scaled := image.NewRGBA(g.Bounds(img.Bounds()))
+	g.Draw(scaled, img)
+
+	// image's width and height
+	width, height := float64(scaled.Bounds().Dx()), float64(scaled.Bounds().Dy())
+
+	animation := &gif.GIF{}
+	for i := 0; i <= MaskRevealFrames; i++ {
+		strength := float64(i) / float64(MaskRevealFrames)
+
+		// pixelate faces with increasing strength
+		frame := image.NewRGBA(scaled.Bounds())
+		draw.Draw(frame, frame.Bounds(), scaled, image.ZP, draw.Src)
+		for _, f := range detected.Result.Faces {
+			// skip zero-size faces
+			rect, ok := regionRect(f.X, f.Y, f.X+f.W, f.Y+f.H, width, height, frame.Bounds())
+			if !ok {
+				continue
+			}
+
+			blockSize := int(float64(pixelateBlockSize(width*f.W)) * strength)
+			if blockSize < 1 {
+				blockSize = 1
+			}
+
+			pixelate(frame, rect, blockSize)
+		}
+
+		paletted := image.NewPaletted(frame.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, frame.Bounds(), frame, image.ZP)
+
+		// hold the first and the last frames a little longer
+		delay := MaskRevealFrameDelay
+		if i == 0 || i == MaskRevealFrames {
+			delay = MaskRevealHoldDelay
+		}
+
+		animation.Image = append(animation.Image, paletted)
+		animation.Delay = append(animation.Delay, delay)
+	}
+
+	return animation
+}
+
+// pixel rect of a detected region with given normalized coordinates, clamped to given bounds
+//
+// (returns false if the region is empty, eg. zero or negative width/height)
+func regionRect(x1, y1, x2, y2, width, height float64, bounds image.Rectangle) (image.Rectangle, bool) {
+	if x2 <= x1 || y2 <= y1 {
+		return image.ZR, false
+	}
+
+	rect := image.Rect(int(width*x1), int(height*y1), int(width*x2), int(height*y2)).Intersect(bounds)
+
+	return rect, !rect.Empty()
+}
+
+// crop given rect (with padding) from an image, clamped to the image's bounds
+func cropImage(img image.Image, rect image.Rectangle, paddingRatio float64) image.Image {
+	paddingX, paddingY := int(float64(rect.Dx())*paddingRatio), int(float64(rect.Dy())*paddingRatio)
+	rect = image.Rect(
+		rect.Min.X-paddingX,
+		rect.Min.Y-paddingY,
+		rect.Max.X+paddingX,
+		rect.Max.Y+paddingY,
+	).Intersect(img.Bounds())
+
+	cropped := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, rect.Min, draw.Src)
+
+	return cropped
+}
+
+// send given images (with captions) as media groups
+//
+// (split into multiple media groups when there are too many images)
+func sendImagesAsMediaGroups(b *bot.Bot, chatID, replyToMessageID int64, imgs []image.Image, captions []string) error {
+	for start := 0; start < len(imgs); start += MaxMediaGroupSize {
+		end := start + MaxMediaGroupSize
+		if end > len(imgs) {
+			end = len(imgs)
+		}
+
+		// encode images (finished like other results)
+		encoded := [][]byte{}
+		for _, img := range imgs[start:end] {
+			data, err := finishResult(img)
+			if err != nil {
+				return fmt.Errorf("failed to encode image: %s", err)
+			}
+			encoded = append(encoded, data)
+		}
+
+		// media group needs at least 2 media, so send a single photo instead
+		if len(encoded) == 1 {
+			if sent := withResultTTL(b, sendPhoto(
+				b,
+				chatID,
+				bot.InputFileFromBytes(encoded[0]),
+				photoOptions(replyToMessageID).SetCaption(captions[start]),
+			)); !sent.Ok {
+				return fmt.Errorf("failed to send image: %s", *sent.Description)
+			}
+
+			continue
+		}
+
+		media := []bot.InputMedia{}
+		options := bot.OptionsSendMediaGroup{}
+		if replyToMessageID != 0 {
+			options.SetReplyToMessageID(replyToMessageID).SetAllowSendingWithoutReply(true)
+		}
+		for i, bytes := range encoded {
+			caption := captions[start+i]
+			attachName := fmt.Sprintf("photo%d", i)
+
+			media = append(media, bot.InputMedia{
+				Type:    bot.InputMediaPhoto,
+				Media:   "attach://" + attachName,
+				Caption: &caption,
+			})
+			options[attachName] = bot.InputFileFromBytes(bytes)
+		}
+
+		if sent := sendMediaGroup(b, chatID, media, options); sent.Ok {
+			scheduleResultDeletion(b, sent.Result...)
+		} else {
+			return fmt.Errorf("failed to send media group: %s", *sent.Description)
+		}
+	}
+
+	return nil
+}
+
+// wait for `retry_after` seconds when given response was rejected by telegram's flood control (429),
+// and return whether the request should be retried
+func waitForRetryAfter(response bot.APIResponseBase, attempt int) bool {
+	if response.Ok || response.Parameters == nil || response.Parameters.RetryAfter <= 0 {
+		return false
+	}
+
+	retryAfter := response.Parameters.RetryAfter
+	if attempt >= MaxFloodControlRetries || retryAfter > MaxRetryAfterSeconds {
+		logError(fmt.Sprintf("Giving up a request rejected by flood control (retry after %d seconds, attempt %d)", retryAfter, attempt+1))
+		return false
+	}
+
+	logMessage(fmt.Sprintf("Rate limited by flood control, retrying after %d seconds", retryAfter))
+	time.Sleep(time.Duration(retryAfter) * time.Second)
+
+	return true
+}
+
+// send a message, retrying when rate limited
+func sendMessage(b *bot.Bot, chatID bot.ChatID, text string, options bot.OptionsSendMessage) (sent bot.APIResponseMessage) {
+	for attempt := 0; ; attempt++ {
+		if sent = b.SendMessage(chatID, text, options); !waitForRetryAfter(sent.APIResponseBase, attempt) {
+			return sent
+		}
+	}
+}
+
+// send a photo, retrying when rate limited
+func sendPhoto(b *bot.Bot, chatID bot.ChatID, photo bot.InputFile, options bot.OptionsSendPhoto) (sent bot.APIResponseMessage) {
+	for attempt := 0; ; attempt++ {
+		if sent = b.SendPhoto(chatID, photo, options); !waitForRetryAfter(sent.APIResponseBase, attempt) {
+			return sent
+		}
+	}
+}
+
+// send an animation, retrying when rate limited
+func sendAnimation(b *bot.Bot, chatID bot.ChatID, animation bot.InputFile, options bot.OptionsSendAnimation) (sent bot.APIResponseMessage) {
+	for attempt := 0; ; attempt++ {
+		if sent = b.SendAnimation(chatID, animation, options); !waitForRetryAfter(sent.APIResponseBase, attempt) {
+			return sent
+		}
+	}
+}
+
+// send a media group, retrying when rate limited
+func sendMediaGroup(b *bot.Bot, chatID bot.ChatID, media []bot.InputMedia, options bot.OptionsSendMediaGroup) (sent bot.APIResponseMessages) {
+	for attempt := 0; ; attempt++ {
+		if sent = b.SendMediaGroup(chatID, media, options); !waitForRetryAfter(sent.APIResponseBase, attempt) {
+			return sent
+		}
+	}
+}
+
+// delete given (result) messages after `result-ttl-seconds`
+//
+// (scheduled deletions are lost when the bot is restarted)
+func scheduleResultDeletion(b *bot.Bot, messages ...bot.Message) {
+	if conf.ResultTTLSeconds <= 0 || len(messages) <= 0 {
+		return
+	}
+
+	go func() {
+		time.Sleep(time.Duration(conf.ResultTTLSeconds) * time.Second)
+
+		for _, message := range messages {
+			if deleted := b.DeleteMessage(message.Chat.ID, message.MessageID); !deleted.Ok {
+				logError(fmt.Sprintf("Failed to delete expired result message %d: %s", message.MessageID, *deleted.Description))
+			}
+		}
+	}()
+}
+
+// schedule deletion of the result message which was sent with given response (if it was sent successfully)
+func withResultTTL(b *bot.Bot, sent bot.APIResponseMessage) bot.APIResponseMessage {
+	if sent.Ok && sent.Result != nil {
+		scheduleResultDeletion(b, *sent.Result)
+	}
+
+	return sent
+}
+
+// options for sending a photo (as a reply to given message, if any)
+//
+// (still sent when the original message was deleted in the meantime)
+func photoOptions(replyToMessageID int64) bot.OptionsSendPhoto {
+	options := bot.OptionsSendPhoto{}
+	if replyToMessageID != 0 {
+		options.SetReplyToMessageID(replyToMessageID).SetAllowSendingWithoutReply(true)
+	}
+	return options
+}
+
+// options for sending an animation (as a reply to given message, if any)
+func animationOptions(replyToMessageID int64) bot.OptionsSendAnimation {
+	options := bot.OptionsSendAnimation{}
+	if replyToMessageID != 0 {
+		options.SetReplyToMessageID(replyToMessageID).SetAllowSendingWithoutReply(true)
+	}
+	return options
+}
+
+// options for sending a message (as a reply to given message, if any)
+func messageOptions(replyToMessageID int64) bot.OptionsSendMessage {
+	options := bot.OptionsSendMessage{}
+	if replyToMessageID != 0 {
+		options.SetReplyToMessageID(replyToMessageID).SetAllowSendingWithoutReply(true)
+	}
+	return options
+}
+
+// id of the original image message which given (keyboard) message replies to
+//
+// (0 if it is not available, eg. already deleted)
+func originalMessageID(message *bot.Message) int64 {
+	if message != nil && message.ReplyToMessage != nil {
+		return message.ReplyToMessage.MessageID
+	}
+	return 0
+}
+
+// send given images (with entry names) as a zip archive
+func sendImagesAsZip(b *bot.Bot, chatID, replyToMessageID int64, imgs []image.Image, names []string, caption string) error {
+	buf := new(bytes.Buffer)
+	writer := zip.NewWriter(buf)
+	for i, img := range imgs {
+		entry, err := writer.Create(names[i])
+		if err != nil {
+			return fmt.Errorf("failed to create archive entry: %s", err)
+		}
+		if err := jpeg.Encode(entry, img, nil); err != nil {
+			return fmt.Errorf("failed to encode image: %s", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to close archive: %s", err)
+	}
+
+	return sendDocument(b, chatID, replyToMessageID, "results-*.zip", buf.Bytes(), caption)
+}
+
+// draw a box with given corners (in pixels), with sharp or rounded corners and solid or dashed lines as configured
+func drawBox(gc *draw2dimg.GraphicContext, x1, y1, x2, y2 float64) {
+	if conf.DashedLines {
+		gc.SetLineDash([]float64{DashLength, DashGap}, 0)
+		defer gc.SetLineDash(nil, 0)
+	}
+
+	if r := math.Min(x2-x1, y2-y1) * BoxCornerRadiusRatio; conf.BoxCornerStyle == boxCornerRounded && r > 0 {
+		gc.MoveTo(x1+r, y1)
+		gc.ArcTo(x2-r, y1+r, r, r, -math.Pi/2, math.Pi/2) // top-right
+		gc.ArcTo(x2-r, y2-r, r, r, 0, math.Pi/2)          // bottom-right
+		gc.ArcTo(x1+r, y2-r, r, r, math.Pi/2, math.Pi/2)  // bottom-left
+		gc.ArcTo(x1+r, y1+r, r, r, math.Pi, math.Pi/2)    // top-left
+	} else {
+		gc.MoveTo(x1, y1)
+		gc.LineTo(x2, y1)
+		gc.LineTo(x2, y2)
+		gc.LineTo(x1, y2)
+		gc.LineTo(x1, y1)
+	}
+	gc.Close()
+	gc.FillStroke()
+}
+
+// draw lines connecting given (normalized) points
+func drawPolyline(gc *draw2dimg.GraphicContext, points []kakaoapi.Point, width, height float64, closed bool) {
+	if len(points) < 2 {
+		return
+	}
+
+	gc.MoveTo(width*points[0].X(), height*points[0].Y())
+	for _, p := range points[1:] {
+		gc.LineTo(width*p.X(), height*p.Y())
+	}
+	if closed {
+		gc.LineTo(width*points[0].X(), height*points[0].Y())
+	}
+	gc.Stroke()
+}
+
+// label of a detected product, with its dimensions (in pixels) if `product-label-dimensions` is set
+func productLabel(class string, width, height float64) string {
+	if !conf.ProductLabelDimensions {
+		return class
+	}
+
+	aspect := 0.0
+	if height > 0 {
+		aspect = width / height
+	}
+	return fmt.Sprintf("%s (%.0fx%.0f = %.0fpx, aspect %.2f)", class, width, height, width*height, aspect)
+}
+
+func processImageForProducts(img image.Image, detected kakaoapi.ResponseDetectedProduct, palette []color.RGBA) (image.Image, []string) {
+	var err error
+
+	// image's width and height
+	width, height := float64(detected.Result.Width), float64(detected.Result.Height)
+
+	newImg := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(newImg, newImg.Bounds(), img, image.ZP, draw.Src)
+	gc := draw2dimg.NewGraphicContext(newImg)
+	gc.SetLineWidth(StrokeWidth)
+	gc.SetFillColor(color.Transparent)
+
+	// build up facial attributes string
+	//
+	// (objects are kept in the order of api response, as it has no per-object scores for sorting them)
+	classes := []string{}
+	for i, o := range detected.Result.Objects {
+		label := productLabel(o.Class, width*(o.X2-o.X1), height*(o.Y2-o.Y1))
+		classes = append(classes, label)
+
+		// skip drawing zero-size products (but keep them in the list)
+		if _, ok := regionRect(o.X1, o.Y1, o.X2, o.Y2, width, height, newImg.Bounds()); !ok {
+			continue
+		}
+
+		// prepare freetype font
+		fc := freetype.NewContext()
+		fc.SetFont(font)
+		fc.SetDPI(72)
+		fc.SetClip(newImg.Bounds())
+		fc.SetDst(newImg)
+		fontSize := float64(newImg.Bounds().Dy()) / 24.0
+		fc.SetFontSize(fontSize)
+
+		// set color
+		color := colorForIndex(palette, i)
+		gc.SetStrokeColor(color)
+		fc.SetSrc(&image.Uniform{labelColor(color)})
+
+		// draw rectangles and their indices on detected product
+		drawBox(gc, width*o.X1, height*o.Y1, width*o.X2, height*o.Y2)
+
+		// draw product label
+		if conf.LabelStyle == labelStyleBadge {
+			drawBadge(newImg, fmt.Sprintf("%d", i+1), color, width*o.X1, height*o.Y1, width*o.X2, height*o.Y2)
+		} else {
+			if _, err = fc.DrawString(
+				fmt.Sprintf("#%d: %s", i+1, label),
+				freetype.Pt(
+					int(width*o.X1+5),
+					int(fc.PointToFixed(height*o.Y2-5)>>6),
+				),
+			); err != nil {
+				logError(fmt.Sprintf("Failed to draw string: %s", err))
+			}
+		}
+	}
+	gc.Save()
+
+	return newImg, classes
+}
+
+func processImageForPoses(img image.Image, analyzed kakaoapi.ResponseAnalyzedPose, palette []color.RGBA) image.Image {
+	// copy to a new image
+	newImg := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(newImg, newImg.Bounds(), img, image.ZP, draw.Src)
+
+	drawPoses(newImg, analyzed, palette)
+
+	return newImg
+}
+
+// draw poses on a blank white canvas of the original image's size (for sharing poses without the photo)
+func processImageForPoseSilhouette(img image.Image, analyzed kakaoapi.ResponseAnalyzedPose, palette []color.RGBA) image.Image {
+	newImg := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(newImg, newImg.Bounds(), &image.Uniform{color.White}, image.ZP, draw.Src)
+
+	drawPoses(newImg, analyzed, palette)
+
+	return newImg
+}
+
+// analyze poses of horizontally flipped image, then flip their coordinates back for drawing on the original one
+//
+// (for keeping left/right of mirrored selfies from front cameras consistent)
+func analyzeMirroredPoses(client timedKakaoClient, correlationID string, imgBytes []byte) (kakaoapi.ResponseAnalyzedPose, error) {
+	img, err := decodeImage(correlationID, imgBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// flip image
+	g := gift.New(gift.FlipHorizontal())
+	flipped := image.NewRGBA(g.Bounds(img.Bounds()))
+	g.Draw(flipped, img)
+
+	buf := new(bytes.Buffer)
+	if err = jpeg.Encode(buf, flipped, nil); err != nil {
+		return nil, err
+	}
+
+	var analyzed kakaoapi.ResponseAnalyzedPose
+	if analyzed, err = client.AnalyzePoseFromBytes(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// flip coordinates back
+	width := float64(img.Bounds().Dx())
+	for i, pose := range analyzed {
+		keyPoints := make([]float64, len(pose.KeyPoints))
+		copy(keyPoints, pose.KeyPoints)
+		for j := 0; j+2 < len(keyPoints); j += 3 { // x, y, score
+			keyPoints[j] = width - keyPoints[j]
+		}
+		analyzed[i].KeyPoints = keyPoints
+
+		if len(pose.BoundingBoxes) >= 4 { // x, y, w, h
+			bbox := make([]float64, len(pose.BoundingBoxes))
+			copy(bbox, pose.BoundingBoxes)
+			bbox[0] = width - bbox[0] - bbox[2]
+			analyzed[i].BoundingBoxes = bbox
+		}
+	}
+
+	return analyzed, nil
+}
+
+// draw keypoints and lines of given poses on given image
+func drawPoses(newImg *image.RGBA, analyzed kakaoapi.ResponseAnalyzedPose, palette []color.RGBA) {
+	gc := draw2dimg.NewGraphicContext(newImg)
+	gc.SetLineWidth(conf.PoseStrokeWidth)
+	gc.SetFillColor(color.Transparent)
+
+	// draw lines on poses
+	for i, pose := range analyzed {
+		// mark keypoints (filled, so that they don't look like rings with thick strokes)
+		if !conf.PoseSkeletonOnly {
+			for _, k := range poseKeyPoints {
+				gc.SetStrokeColor(poseColor(palette, i, k.part))
+				gc.SetFillColor(poseColor(palette, i, k.part))
+
+				x, y, score := pose.KeyPointFor(k.index)
+				radius := posePointRadius(score)
+				gc.MoveTo(x, y)
+				gc.ArcTo(x, y, radius, radius, 0, -math.Pi*2)
+				gc.Close()
+				gc.FillStroke()
+			}
+		}
+
+		// connect them
+		if !conf.PoseDotsOnly {
+			gc.SetFillColor(color.Transparent)
+			line := func(fromX, fromY, toX, toY float64, part bodyPart) {
+				gc.SetStrokeColor(poseColor(palette, i, part))
+				gc.MoveTo(fromX, fromY)
+				gc.LineTo(toX, toY)
+				gc.Close()
+				gc.FillStroke()
+			}
+
+			for _, c := range poseConnections {
+				fromX, fromY, _ := pose.KeyPointFor(c.from)
+				toX, toY, _ := pose.KeyPointFor(c.to)
+				line(fromX, fromY, toX, toY, c.part)
+			}
+
+			if conf.PoseTorsoStyle == poseTorsoSpine {
+				// neck and spine
+				noseX, noseY, _ := pose.KeyPointFor(kakaoapi.KeyPointIndexNose)
+				neckX, neckY := poseMidpoint(pose, kakaoapi.KeyPointIndexLeftShoulder, kakaoapi.KeyPointIndexRightShoulder)
+				pelvisX, pelvisY := poseMidpoint(pose, kakaoapi.KeyPointIndexLeftHip, kakaoapi.KeyPointIndexRightHip)
+				line(noseX, noseY, neckX, neckY, bodyPartHead)
+				line(neckX, neckY, pelvisX, pelvisY, bodyPartTorso)
+			} else {
+				for _, c := range poseCrossConnections {
+					fromX, fromY, _ := pose.KeyPointFor(c.from)
+					toX, toY, _ := pose.KeyPointFor(c.to)
+					line(fromX, fromY, toX, toY, bodyPartTorso)
+				}
+			}
+		}
+	}
+
+	gc.Save()
+}
+
+func processImageForTexts(img image.Image, detected kakaoapi.ResponseDetectedText, palette []color.RGBA) (image.Image, []string) {
+	var err error
+
+	// copy to a new image
+	newImg := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(newImg, newImg.Bounds(), img, image.ZP, draw.Src)
+	gc := draw2dimg.NewGraphicContext(newImg)
+	gc.SetLineWidth(StrokeWidth)
+	gc.SetFillColor(color.Transparent)
+
+	// draw numbered polygons on detected texts
+	lines := []string{}
+	for i, result := range detected.Result {
+		lines = append(lines, fmt.Sprintf("#%d: %s", i+1, strings.Join(result.RecognizedWords, " ")))
+
+		// skip invalid polygons
+		points := [][]int{}
+		for _, p := range result.Boxes {
+			if len(p) >= 2 {
+				points = append(points, p)
+			}
+		}
+		if len(points) < 2 {
+			continue
+		}
+
+		// set color
+		color := colorForIndex(palette, i)
+		gc.SetStrokeColor(color)
+
+		// draw polygon
+		minX, minY, maxX, maxY := textBounds(result.Boxes)
+		gc.MoveTo(float64(points[0][0]), float64(points[0][1]))
+		for _, p := range points[1:] {
+			gc.LineTo(float64(p[0]), float64(p[1]))
+		}
+		gc.LineTo(float64(points[0][0]), float64(points[0][1]))
+		gc.Close()
+		gc.FillStroke()
+
+		// draw index
+		if conf.LabelStyle == labelStyleBadge {
+			drawBadge(newImg, fmt.Sprintf("%d", i+1), color, float64(minX), float64(minY), float64(maxX), float64(maxY))
+		} else {
+			// prepare freetype font
+			fc := freetype.NewContext()
+			fc.SetFont(font)
+			fc.SetDPI(72)
+			fc.SetClip(newImg.Bounds())
+			fc.SetDst(newImg)
+			fontSize := math.Max(float64(maxY-minY), 8.0)
+			fc.SetFontSize(fontSize)
+			fc.SetSrc(&image.Uniform{color})
+
+			// above the polygon, or inside it when there is no room
+			baseline := minY - 2
+			if float64(baseline) < fontSize {
+				baseline = minY + int(fontSize)
+			}
+
+			if _, err = fc.DrawString(
+				fmt.Sprintf("%d", i+1),
+				freetype.Pt(minX+2, baseline),
+			); err != nil {
+				logError(fmt.Sprintf("Failed to draw string: %s", err))
+			}
+		}
+	}
+	gc.Save()
+
+	return newImg, lines
+}
+
+// bounding box of a detected text's polygon
+func textBounds(boxes kakaoapi.DetectedTextBounds) (minX, minY, maxX, maxY int) {
+	first := true
+	for _, p := range boxes {
+		if len(p) < 2 {
+			continue
+		}
+
+		if first {
+			minX, minY, maxX, maxY = p[0], p[1], p[0], p[1]
+			first = false
+			continue
+		}
+
+		if p[0] < minX {
+			minX = p[0]
+		}
+		if p[1] < minY {
+			minY = p[1]
+		}
+		if p[0] > maxX {
+			maxX = p[0]
+		}
+		if p[1] > maxY {
+			maxY = p[1]
+		}
+	}
+
+	return minX, minY, maxX, maxY
+}
+
+// sort detected texts top-to-bottom, then left-to-right in each line
+//
+// (a text belongs to the current line if its vertical center is within the line's range)
+func sortTextsInReadingOrder(detected kakaoapi.ResponseDetectedText) kakaoapi.ResponseDetectedText {
+	results := detected.Result
+
+	// top-to-bottom
+	sort.SliceStable(results, func(i, j int) bool {
+		_, topI, _, _ := textBounds(results[i].Boxes)
+		_, topJ, _, _ := textBounds(results[j].Boxes)
+		return topI < topJ
+	})
+
+	// group into lines, then sort each line left-to-right
+	for start := 0; start < len(results); {
+		_, lineTop, _, lineBottom := textBounds(results[start].Boxes)
+
+		end := start + 1
+		for ; end < len(results); end++ {
+			_, top, _, bottom := textBounds(results[end].Boxes)
+			if center := (top + bottom) / 2; center < lineTop || center > lineBottom {
+				break
+			}
+		}
+
+		line := results[start:end]
+		sort.SliceStable(line, func(i, j int) bool {
+			leftI, _, _, _ := textBounds(line[i].Boxes)
+			leftJ, _, _, _ := textBounds(line[j].Boxes)
+			return leftI < leftJ
+		})
+
+		start = end
+	}
+	detected.Result = results
+
+	return detected
+}
+
+// midpoint of given two keypoints of a pose
+func poseMidpoint(pose kakaoapi.AnalyzedPose, a, b kakaoapi.KeyPointIndex) (x, y float64) {
+	ax, ay, _ := pose.KeyPointFor(a)
+	bx, by, _ := pose.KeyPointFor(b)
+
+	return (ax + bx) / 2, (ay + by) / 2
+}
+
+// radius of a keypoint's dot, scaled by its confidence score
+//
+// (score of 0.5 results in `pose-point-radius`, and min/max are scaled along with it)
+func posePointRadius(score float64) float64 {
+	scale := conf.PosePointRadius / PosePointRadius
+	minRadius, maxRadius := PosePointRadiusMin*scale, PosePointRadiusMax*scale
+
+	radius := conf.PosePointRadius * score * 2
+	if radius < minRadius {
+		radius = minRadius
+	} else if radius > maxRadius {
+		radius = maxRadius
+	}
+
+	return radius
+}
+
+// color for drawing a part of a pose at given index
+func poseColor(palette []color.RGBA, poseIndex int, part bodyPart) color.RGBA {
+	if conf.PoseColoring == poseColoringBodyPart {
+		return bodyPartColors[part]
+	}
+
+	return colorForIndex(palette, poseIndex)
+}
+
+// enqueue an image processing job without blocking (returns false when the queue is full)
+//
+// (status message of the job should be edited before this, as the worker owns it after being enqueued)
+func enqueueImageJob(job imageJob) bool {
+	select {
+	case imageJobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// position of a new job in the queue (0 if a worker is idle, so it will be processed immediately)
+//
+// (approximate, as other jobs can be enqueued or taken concurrently)
+func queuePosition() int {
+	if int(atomic.LoadInt32(&busyWorkers)) < conf.NumWorkers {
+		return 0
+	}
+	return len(imageJobs) + 1
+}
+
+// status message for processing given command, with the position in the queue (if waiting)
+func processingMessage(command VisionCommand, position int) string {
+	if position > 0 {
+		return fmt.Sprintf(messageProcessing+"\n\n"+messageQueuePosition, command, position)
+	}
+	return fmt.Sprintf(messageProcessing, command)
+}
+
+// process queued image processing jobs one by one
+func processImageJobs(b *bot.Bot) {
+	for job := range imageJobs {
+		atomic.AddInt32(&busyWorkers, 1)
+		processImage(b, job)
+		atomic.AddInt32(&busyWorkers, -1)
+	}
+}
+
+// frames of the progress spinner (appended to the status message)
+var progressSpinnerFrames = []string{".", "..", "..."}
+
+// start cycling ellipses of the status message with given id, and return a function for stopping it
+//
+// (the returned function waits for the last edit to finish, so the message can be deleted right after it)
+func startProgressSpinner(b *bot.Bot, chatID, messageID int64, text string) (stop func()) {
+	if !conf.AnimateProgress {
+		return func() {}
+	}
+
+	text = strings.TrimSuffix(text, "...")
+	quit, finished := make(chan struct{}), make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(ProgressSpinnerIntervalSeconds * time.Second)
+		defer ticker.Stop()
+
+		for i := 0; ; i++ {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				b.EditMessageText(
+					text+progressSpinnerFrames[i%len(progressSpinnerFrames)],
+					bot.OptionsEditMessageText{}.SetIDs(chatID, messageID),
+				)
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-finished
+	}
+}
+
+// process requested image processing
+func processImage(b *bot.Bot, job imageJob) {
+	correlationID, command := job.correlationID, job.command
+
+	// results are sent to the routed chat (`result-chat-routes`), or the sender's chat
+	chatID, replyToMessageID := resultChatFor(job.chatID), job.replyToMessageID
+	if chatID != job.chatID {
+		job.replyToMessageID = 0 // (the original message is not in the routed chat)
+	}
+
+	errorMessage := ""
+
+	// title of captions and messages
+	title := func(count int, classes []string) string {
+		return resultTitle(command, job.languageCode, job.forwardedFrom, count, classes)
+	}
+
+	// for reporting to the result webhook
+	summary := ""
+	var resultBytes []byte
+
+	// 'typing...'
+	b.SendChatAction(chatID, bot.ChatActionTyping)
+
+	// remove the position in the queue from the status message, as it's out of the queue now
+	if job.queuePosition > 0 && !conf.AnimateProgress {
+		b.EditMessageText(fmt.Sprintf(messageProcessing, command), bot.OptionsEditMessageText{}.SetIDs(job.chatID, job.messageIDToDelete))
+	}
+
+	// animate the status message while processing
+	stopSpinner := startProgressSpinner(b, job.chatID, job.messageIDToDelete, fmt.Sprintf(messageProcessing, command))
+
+	var imgBytes []byte
+	var err error
+
+	// colors for annotating images of this chat
+	palette := paletteFor(job.chatID)
+
+	// kakao api client for this request (nil when dry-running without api keys)
+	kakaoClient := timedKakaoClient{nextKakaoClient()}
+
+	// for measuring time taken by each step
+	timer := newStepTimer()
+
+	// read image file from url (or the download cache)
+	imgBytes, err = readBytesCached(job.fileID, job.fileURL)
+	timer.mark("download")
+
+	// sniff the real format of downloaded bytes (mime types and extensions of uploads can be wrong)
+	if err == nil {
+		switch contentType := sniffContentType(imgBytes); {
+		case contentType == "application/pdf":
+			// use the image of the first page (and tell it in the sender's chat, not in the routed one)
+			var pages int
+			if imgBytes, pages, err = firstPageImageOfPDF(imgBytes); err != nil {
+				err = errUnreadablePDF{err}
+			} else if pages > 1 {
+				sendMessage(b, job.chatID, fmt.Sprintf(messagePDFFirstPageOnly, pages), messageOptions(replyToMessageID))
+			}
+		case !strings.HasPrefix(contentType, "image/"):
+			err = errNotAnImage{contentType}
+		}
+	}
+	if err == nil && conf.DryRun {
+		// skip kakao api calls and send the original image back
+		b.SendChatAction(chatID, bot.ChatActionUploadPhoto)
+
+		resultBytes = imgBytes
+
+		if sent := withResultTTL(b, sendPhoto(
+			b,
+			chatID,
+			bot.InputFileFromBytes(imgBytes),
+			photoOptions(job.replyToMessageID).SetCaption(title(0, nil)+" (dry-run)"),
+		)); !sent.Ok {
+			errorMessage = fmt.Sprintf("Failed to send image: %s", *sent.Description)
+		}
+	} else if err == nil {
+		switch command {
+		case CountFaces:
+			// fast path: no need to decode, draw, encode, or upload images
+			var detected kakaoapi.ResponseDetectedFace
+			var skipped int
+			detected, skipped, err = detectFaces(kakaoClient, imgBytes, 0.7)
+			timer.mark("kakao")
+			if err == nil {
+				count := len(detected.Result.Faces)
+				message := fmt.Sprintf("%s:\n\n%d face(s)%s", title(count, nil), count, skippedSmallFacesNote(skipped))
+				summary = message
+				if sent := withResultTTL(b, sendMessage(b, chatID, message, messageOptions(job.replyToMessageID))); !sent.Ok {
+					errorMessage = fmt.Sprintf("Failed to send face count: %s", *sent.Description)
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect faces: %s", err)
+			}
+		case DetectFaces, MaskFaces, EmojiFaces, BlurBackground:
+			var detected kakaoapi.ResponseDetectedFace
+
+			// NOTE: kakao's face detection api returns no expression/emotion attributes (only gender),
+			// so emotions of faces cannot be reported
+			// (https://developers.kakao.com/docs/latest/ko/vision/dev-guide#recog-face)
+			var skipped int
+			detected, skipped, err = detectFaces(kakaoClient, imgBytes, 0.7)
+			timer.mark("kakao")
+			if err == nil {
+				if len(detected.Result.Faces) > 0 {
+					summary = fmt.Sprintf("%d face(s) detected", len(detected.Result.Faces))
+
+					var img image.Image
+					img, err = decodeImage(correlationID, imgBytes)
+					if err == nil && command == MaskFaces && conf.MaskFacesAnimation && (job.maskStyle == "" || job.maskStyle == maskStylePixelate) {
+						// 'uploading video...'
+						b.SendChatAction(chatID, bot.ChatActionUploadVideo)
+
+						// send an animation of masking faces
+						buf := new(bytes.Buffer)
+						err = gif.EncodeAll(buf, maskRevealAnimation(img, detected))
+						timer.mark("draw")
+						if err == nil {
+							resultBytes = buf.Bytes()
+
+							if sent := withResultTTL(b, sendAnimation(
+								b,
+								chatID,
+								bot.InputFileFromBytes(buf.Bytes()),
+								animationOptions(job.replyToMessageID).SetCaption(title(len(detected.Result.Faces), nil)+skippedSmallFacesNote(skipped)),
+							)); !sent.Ok {
+								errorMessage = fmt.Sprintf("Failed to send animation: %s", *sent.Description)
+							}
+						} else {
+							errorMessage = fmt.Sprintf("Failed to encode animation: %s", err)
+						}
+					} else if err == nil {
+						// process image
+						newImg := processImageForFaces(img, detected, command, job.maskStyle, palette)
+						timer.mark("draw")
+
+						if command == DetectFaces && conf.ArchiveResults {
+							// send the image and its reports together as a zip archive
+							report := fmt.Sprintf("%s:\n\n%s%s", title(len(detected.Result.Faces), nil), summary, skippedSmallFacesNote(skipped))
+							resultBytes, errorMessage = sendResultImageArchive(b, chatID, job.replyToMessageID, command, newImg, report, title(len(detected.Result.Faces), nil), detected.Result.Width, detected.Result.Height, faceDetections(detected))
+						} else {
+							// send a photo with rectangles drawn on detected faces
+							resultBytes, errorMessage = sendResultImage(b, chatID, job.replyToMessageID, newImg, title(len(detected.Result.Faces), nil)+skippedSmallFacesNote(skipped))
+						}
+
+						// send coordinates of detected faces (when not archived with the image)
+						if errorMessage == "" && command == DetectFaces && conf.SendDetectionsCSV && !conf.ArchiveResults {
+							if err = sendDetectionsCSV(b, chatID, job.replyToMessageID, detected.Result.Width, detected.Result.Height, faceDetections(detected)); err != nil {
+								errorMessage = fmt.Sprintf("Failed to send detections: %s", err)
+							}
+						}
+					} else {
+						errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+					}
+				} else {
+					errorMessage = "No face detected on this image." + skippedSmallFacesNote(skipped)
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect faces: %s", err)
+			}
+		case DetectAndMaskFaces:
+			var detected kakaoapi.ResponseDetectedFace
+			var skipped int
+			detected, skipped, err = detectFaces(kakaoClient, imgBytes, 0.7)
+			timer.mark("kakao")
+			if err == nil {
+				if len(detected.Result.Faces) > 0 {
+					summary = fmt.Sprintf("%d face(s) detected", len(detected.Result.Faces))
+
+					var img image.Image
+					img, err = decodeImage(correlationID, imgBytes)
+					if err == nil {
+						// process image for both of them with the result of one api call
+						masked := processImageForFaces(img, detected, MaskFaces, maskStylePixelate, palette)
+						labeled := processImageForFaces(img, detected, DetectFaces, "", palette)
+						timer.mark("draw")
+
+						// 'uploading photo...'
+						b.SendChatAction(chatID, bot.ChatActionUploadPhoto)
+
+						// send them together as a media group
+						caption := title(len(detected.Result.Faces), nil)
+						note := skippedSmallFacesNote(skipped)
+						if err = sendImagesAsMediaGroups(
+							b,
+							chatID,
+							job.replyToMessageID,
+							[]image.Image{masked, labeled},
+							[]string{caption + " (masked)" + note, caption + " (labeled)" + note},
+						); err != nil {
+							errorMessage = fmt.Sprintf("Failed to send images: %s", err)
+						}
+					} else {
+						errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+					}
+				} else {
+					errorMessage = "No face detected on this image." + skippedSmallFacesNote(skipped)
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect faces: %s", err)
+			}
+		case DetectAll:
+			var faces kakaoapi.ResponseDetectedFace
+			var skipped int
+			var products kakaoapi.ResponseDetectedProduct
+			if faces, skipped, err = detectFaces(kakaoClient, imgBytes, 0.7); err == nil {
+				products, err = kakaoClient.DetectProductFromBytes(imgBytes, conf.ProductDetectionThreshold)
+			}
+			timer.mark("kakao")
+			if err == nil {
+				// remove overlapping products, and ones overlapping faces
+				var suppressed, suppressedByFaces int
+				products, suppressed = suppressOverlappingProducts(products)
+				products, suppressedByFaces = suppressProductsOverlappingFaces(products, faces)
+
+				if len(faces.Result.Faces) > 0 || len(products.Result.Objects) > 0 {
+					summary = fmt.Sprintf("%d face(s) and %d product(s) detected", len(faces.Result.Faces), len(products.Result.Objects))
+
+					var img image.Image
+					img, err = decodeImage(correlationID, imgBytes)
+					if err == nil {
+						// draw products over faces
+						newImg, classes := processImageForProducts(processImageForFaces(img, faces, DetectFaces, "", palette), products, palette)
+						timer.mark("draw")
+
+						// send a photo with rectangles drawn on detected faces and products
+						caption := fmt.Sprintf("%s:\n\n%s%s", title(len(faces.Result.Faces)+len(products.Result.Objects), classes), summary, suppressedProductsNote(suppressed))
+						if suppressedByFaces > 0 {
+							caption += fmt.Sprintf("\n(%d product(s) overlapping faces removed)", suppressedByFaces)
+						}
+						caption += skippedSmallFacesNote(skipped)
+						resultBytes, errorMessage = sendResultImage(b, chatID, job.replyToMessageID, newImg, caption)
+					} else {
+						errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+					}
+				} else {
+					errorMessage = "No face or product detected on this image." + skippedSmallFacesNote(skipped)
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect faces and products: %s", err)
+			}
+		case ReportCard:
+			var faces kakaoapi.ResponseDetectedFace
+			var skipped int
+			var products kakaoapi.ResponseDetectedProduct
+			var nsfw kakaoapi.ResponseDetectedNSFW
+			var tags kakaoapi.ResponseGeneratedTags
+			if faces, skipped, err = detectFaces(kakaoClient, imgBytes, 0.7); err == nil {
+				if products, err = kakaoClient.DetectProductFromBytes(imgBytes, conf.ProductDetectionThreshold); err == nil {
+					if nsfw, err = kakaoClient.DetectNSFWFromBytes(imgBytes); err == nil {
+						tags, err = kakaoClient.GenerateTagsFromBytes(imgBytes)
+					}
+				}
+			}
+			timer.mark("kakao")
+			if err == nil {
+				products, _ = suppressOverlappingProducts(products)
+
+				lines := reportCardLines(faces, products, nsfw, tags)
+				summary = strings.Join(lines, "\n")
+
+				var img image.Image
+				img, err = decodeImage(correlationID, imgBytes)
+				if err == nil {
+					// draw boxes on faces and products, then render the panel next to it
+					annotated, _ := processImageForProducts(processImageForFaces(img, faces, DetectFaces, "", palette), products, palette)
+					newImg := renderReportCard(annotated, lines)
+					timer.mark("draw")
+
+					// send the report card
+					resultBytes, errorMessage = sendResultImage(b, chatID, job.replyToMessageID, newImg, title(len(faces.Result.Faces)+len(products.Result.Objects), tags.Result.Labels)+skippedSmallFacesNote(skipped))
+				} else {
+					errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to run detections: %s", err)
+			}
+		case DetectionHeatmap:
+			var faces kakaoapi.ResponseDetectedFace
+			var skipped int
+			var products kakaoapi.ResponseDetectedProduct
+			if faces, skipped, err = detectFaces(kakaoClient, imgBytes, 0.7); err == nil {
+				products, err = kakaoClient.DetectProductFromBytes(imgBytes, conf.ProductDetectionThreshold)
+			}
+			timer.mark("kakao")
+			if err == nil {
+				products, _ = suppressOverlappingProducts(products)
+
+				// (normalized) centers of detected faces and products
+				centers := [][2]float64{}
+				for _, f := range faces.Result.Faces {
+					centers = append(centers, [2]float64{f.X + f.W/2, f.Y + f.H/2})
+				}
+				for _, o := range products.Result.Objects {
+					centers = append(centers, [2]float64{(o.X1 + o.X2) / 2, (o.Y1 + o.Y2) / 2})
+				}
+
+				if len(centers) > 0 {
+					summary = fmt.Sprintf("%d face(s) and %d product(s) detected", len(faces.Result.Faces), len(products.Result.Objects))
+
+					var img image.Image
+					img, err = decodeImage(correlationID, imgBytes)
+					if err == nil {
+						newImg := densityHeatmap(img, centers)
+						timer.mark("draw")
+
+						// send a photo with the heatmap blended on it
+						resultBytes, errorMessage = sendResultImage(b, chatID, job.replyToMessageID, newImg, fmt.Sprintf("%s:\n\n%s%s", title(len(centers), nil), summary, skippedSmallFacesNote(skipped)))
+					} else {
+						errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+					}
+				} else {
+					errorMessage = "No face or product detected on this image." + skippedSmallFacesNote(skipped)
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect faces and products: %s", err)
+			}
+		case CropFaces:
+			var detected kakaoapi.ResponseDetectedFace
+			var skipped int
+			detected, skipped, err = detectFaces(kakaoClient, imgBytes, 0.7)
+			timer.mark("kakao")
+			if err == nil {
+				if len(detected.Result.Faces) > 0 {
+					summary = fmt.Sprintf("%d face(s) detected", len(detected.Result.Faces))
+
+					var img image.Image
+					img, err = decodeImage(correlationID, imgBytes)
+					if err == nil {
+						// image's width and height
+						width, height := float64(detected.Result.Width), float64(detected.Result.Height)
+
+						// crop faces
+						crops := []image.Image{}
+						captions := []string{}
+						names := []string{}
+						for i, f := range detected.Result.Faces {
+							// skip zero-size faces
+							if rect, ok := regionRect(f.X, f.Y, f.X+f.W, f.Y+f.H, width, height, img.Bounds()); ok {
+								crops = append(crops, cropImage(img, rect, CropPaddingRatio))
+								captions = append(captions, fmt.Sprintf("Face #%d", i+1))
+								names = append(names, fmt.Sprintf("%02d-%s.jpg", i+1, allCmds[command]))
+							}
+						}
+
+						timer.mark("draw")
+
+						if len(crops) > 0 {
+							// 'uploading photo...'
+							b.SendChatAction(chatID, bot.ChatActionUploadPhoto)
+
+							// (note about skipped faces goes to the first caption)
+							captions[0] += skippedSmallFacesNote(skipped)
+
+							if conf.ArchiveMultipleResults {
+								// send cropped faces as a zip archive
+								if err = sendImagesAsZip(b, chatID, job.replyToMessageID, crops, names, title(len(crops), nil)+skippedSmallFacesNote(skipped)); err != nil {
+									errorMessage = fmt.Sprintf("Failed to send cropped faces: %s", err)
+								}
+							} else {
+								// send cropped faces as media groups
+								if err = sendImagesAsMediaGroups(b, chatID, job.replyToMessageID, crops, captions); err != nil {
+									errorMessage = fmt.Sprintf("Failed to send cropped faces: %s", err)
+								}
+							}
+						} else {
+							errorMessage = "No face with a valid region was detected on this image."
+						}
+					} else {
+						errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+					}
+				} else {
+					errorMessage = "No face detected on this image." + skippedSmallFacesNote(skipped)
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect faces: %s", err)
+			}
+		case FaceSheet:
+			var detected kakaoapi.ResponseDetectedFace
+			var skipped int
+			detected, skipped, err = detectFaces(kakaoClient, imgBytes, 0.7)
+			timer.mark("kakao")
+			if err == nil {
+				if len(detected.Result.Faces) > 0 {
+					summary = fmt.Sprintf("%d face(s) detected", len(detected.Result.Faces))
+
+					var img image.Image
+					img, err = decodeImage(correlationID, imgBytes)
+					if err == nil {
+						// image's width and height
+						width, height := float64(detected.Result.Width), float64(detected.Result.Height)
+
+						// crop faces
+						crops := []image.Image{}
+						labels := []string{}
+						for i, f := range detected.Result.Faces {
+							// skip zero-size faces
+							if rect, ok := regionRect(f.X, f.Y, f.X+f.W, f.Y+f.H, width, height, img.Bounds()); ok {
+								crops = append(crops, cropImage(img, rect, CropPaddingRatio))
+								labels = append(labels, fmt.Sprintf("#%d (%.1f%%)", i+1, f.Score*100))
+							}
+						}
+
+						if len(crops) > 0 {
+							// tile them in a sheet
+							newImg := renderFaceSheet(crops, labels)
+							timer.mark("draw")
+
+							// send the face sheet
+							resultBytes, errorMessage = sendResultImage(b, chatID, job.replyToMessageID, newImg, title(len(crops), nil)+skippedSmallFacesNote(skipped))
+						} else {
+							errorMessage = "No face with a valid region was detected on this image."
+						}
+					} else {
+						errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+					}
+				} else {
+					errorMessage = "No face detected on this image." + skippedSmallFacesNote(skipped)
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect faces: %s", err)
+			}
+		case DetectProducts:
+			var detected kakaoapi.ResponseDetectedProduct
+			detected, err = kakaoClient.DetectProductFromBytes(imgBytes, conf.ProductDetectionThreshold)
+			timer.mark("kakao")
+			if err == nil {
+				// remove overlapping products
+				var suppressed int
+				detected, suppressed = suppressOverlappingProducts(detected)
+
+				if len(detected.Result.Objects) > 0 {
+					summary = fmt.Sprintf("%d product(s) detected", len(detected.Result.Objects))
+
+					var img image.Image
+					img, err = decodeImage(correlationID, imgBytes)
+					if err == nil {
+						newImg, classes := processImageForProducts(img, detected, palette)
+						timer.mark("draw")
+
+						report := productsReport(title(len(classes), classes), classes) + suppressedProductsNote(suppressed)
+						if conf.ArchiveResults {
+							// send the image and its reports together as a zip archive
+							resultBytes, errorMessage = sendResultImageArchive(b, chatID, job.replyToMessageID, command, newImg, report, title(len(classes), classes), detected.Result.Width, detected.Result.Height, productDetections(detected))
+						} else if conf.SeparateProductReport {
+							// send a photo without caption, then a text report
+							if resultBytes, errorMessage = sendResultImage(b, chatID, job.replyToMessageID, newImg, ""); errorMessage == "" {
+								if sent := withResultTTL(b, sendMessage(b, chatID, report, messageOptions(job.replyToMessageID))); !sent.Ok {
+									errorMessage = fmt.Sprintf("Failed to send report: %s", *sent.Description)
+								}
+							}
+						} else {
+							// send a photo with rectangles drawn on detected products
+							resultBytes, errorMessage = sendResultImage(b, chatID, job.replyToMessageID, newImg, fmt.Sprintf("%s:\n\n%s%s", title(len(classes), classes), strings.Join(classes, "\n"), suppressedProductsNote(suppressed)))
+						}
+
+						// send coordinates of detected products (when not archived with the image)
+						if errorMessage == "" && conf.SendDetectionsCSV && !conf.ArchiveResults {
+							if err = sendDetectionsCSV(b, chatID, job.replyToMessageID, detected.Result.Width, detected.Result.Height, productDetections(detected)); err != nil {
+								errorMessage = fmt.Sprintf("Failed to send detections: %s", err)
+							}
+						}
+
+						// ask others what detected products are
+						if errorMessage == "" && conf.LabelingPolls {
+							sendLabelingPolls(b, chatID, job.replyToMessageID, correlationID, detected)
+						}
+					} else {
+						errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+					}
+				} else {
+					errorMessage = "No product detected on this image."
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect products: %s", err)
+			}
+		case CropProducts:
+			var detected kakaoapi.ResponseDetectedProduct
+			detected, err = kakaoClient.DetectProductFromBytes(imgBytes, conf.ProductDetectionThreshold)
+			timer.mark("kakao")
+			if err == nil {
+				// remove overlapping products
+				detected, _ = suppressOverlappingProducts(detected)
+
+				if len(detected.Result.Objects) > 0 {
+					summary = fmt.Sprintf("%d product(s) detected", len(detected.Result.Objects))
+
+					var img image.Image
+					img, err = decodeImage(correlationID, imgBytes)
+					if err == nil {
+						// image's width and height
+						width, height := float64(detected.Result.Width), float64(detected.Result.Height)
+
+						// crop products
+						crops := []image.Image{}
+						captions := []string{}
+						names := []string{}
+						for i, o := range detected.Result.Objects {
+							// skip zero-size products
+							if rect, ok := regionRect(o.X1, o.Y1, o.X2, o.Y2, width, height, img.Bounds()); ok {
+								crops = append(crops, cropImage(img, rect, CropPaddingRatio))
+								captions = append(captions, fmt.Sprintf("#%d: %s", i+1, o.Class))
+								names = append(names, fmt.Sprintf("%02d-%s-%s.jpg", i+1, allCmds[command], o.Class))
+							}
+						}
+
+						timer.mark("draw")
+
+						if len(crops) > 0 {
+							// 'uploading photo...'
+							b.SendChatAction(chatID, bot.ChatActionUploadPhoto)
+
+							if conf.ArchiveMultipleResults {
+								// send cropped products as a zip archive
+								if err = sendImagesAsZip(b, chatID, job.replyToMessageID, crops, names, title(len(crops), nil)); err != nil {
+									errorMessage = fmt.Sprintf("Failed to send cropped products: %s", err)
+								}
+							} else {
+								// send cropped products as media groups
+								if err = sendImagesAsMediaGroups(b, chatID, job.replyToMessageID, crops, captions); err != nil {
+									errorMessage = fmt.Sprintf("Failed to send cropped products: %s", err)
+								}
+							}
+						} else {
+							errorMessage = "No product with a valid region was detected on this image."
+						}
+					} else {
+						errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+					}
+				} else {
+					errorMessage = "No product detected on this image."
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect products: %s", err)
+			}
+		case CountProducts:
+			var detected kakaoapi.ResponseDetectedProduct
+			detected, err = kakaoClient.DetectProductFromBytes(imgBytes, conf.ProductDetectionThreshold)
+			timer.mark("kakao")
+			if err == nil {
+				// remove overlapping products
+				detected, _ = suppressOverlappingProducts(detected)
+
+				if len(detected.Result.Objects) > 0 {
+					summary = fmt.Sprintf("%d product(s) detected", len(detected.Result.Objects))
+
+					// send counts of classes
+					lines := []string{}
+					for _, c := range countProductClasses(detected) {
+						lines = append(lines, fmt.Sprintf("%s: %d", c.class, c.count))
+					}
+					message := fmt.Sprintf("%s:\n\n%s", title(len(detected.Result.Objects), nil), strings.Join(lines, "\n"))
+					summary = message
+					if sent := withResultTTL(b, sendMessage(b, chatID, message, messageOptions(job.replyToMessageID))); !sent.Ok {
+						errorMessage = fmt.Sprintf("Failed to send product counts: %s", *sent.Description)
+					}
+				} else {
+					errorMessage = "No product detected on this image."
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect products: %s", err)
+			}
+		case ProductSummary:
+			var detected kakaoapi.ResponseDetectedProduct
+			detected, err = kakaoClient.DetectProductFromBytes(imgBytes, conf.ProductDetectionThreshold)
+			timer.mark("kakao")
+			if err == nil {
+				// remove overlapping products
+				var suppressed int
+				detected, suppressed = suppressOverlappingProducts(detected)
+
+				if len(detected.Result.Objects) > 0 {
+					var img image.Image
+					img, err = decodeImage(correlationID, imgBytes)
+					if err == nil {
+						// individual boxes are still numbered on the image
+						newImg, _ := processImageForProducts(img, detected, palette)
+						timer.mark("draw")
+
+						// tally of categories, in descending order
+						counts := countProductClasses(detected)
+						lines := []string{}
+						classes := []string{}
+						for _, c := range counts {
+							lines = append(lines, fmt.Sprintf("%s: %d", c.class, c.count))
+							classes = append(classes, c.class)
+						}
+						summary = strings.Join(lines, "\n")
+
+						// send a photo with numbered boxes, captioned with the tally
+						resultBytes, errorMessage = sendResultImage(b, chatID, job.replyToMessageID, newImg, fmt.Sprintf("%s:\n\n%s%s", title(len(detected.Result.Objects), classes), summary, suppressedProductsNote(suppressed)))
+					} else {
+						errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+					}
+				} else {
+					errorMessage = "No product detected on this image."
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect products: %s", err)
+			}
 		case DetectNSFW:
 			if detected, err := kakaoClient.DetectNSFWFromBytes(imgBytes); err == nil {
+				timer.mark("kakao")
+
 				// send nsfw factors
-				message := fmt.Sprintf(`Process result of '%s':
+				message := fmt.Sprintf(`%s:
+
+Normal: %.2f%%
+Soft: %.2f%%
+Adult: %.2f%%`,
+					title(0, nil),
+					100.0*detected.Result.Normal,
+					100.0*detected.Result.Soft,
+					100.0*detected.Result.Adult,
+				)
+				summary = message
+
+				// or, formatted one
+				options := messageOptions(job.replyToMessageID)
+				if conf.FormatTextResults {
+					message = fmt.Sprintf("*%s:*\n\nNormal: `%.2f%%`\nSoft: `%.2f%%`\nAdult: `%.2f%%`",
+						escapeMarkdownV2(title(0, nil)),
+						100.0*detected.Result.Normal,
+						100.0*detected.Result.Soft,
+						100.0*detected.Result.Adult,
+					)
+					options.SetParseMode(bot.ParseModeMarkdownV2)
+				}
+
+				if sent := withResultTTL(b, sendMessage(b, chatID, message, options)); !sent.Ok {
+					errorMessage = fmt.Sprintf("Failed to send nsfw factors: %s", *sent.Description)
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect NSFW factors from image: %s", err)
+			}
+		case Tag:
+			if generated, err := kakaoClient.GenerateTagsFromBytes(imgBytes); err == nil {
+				timer.mark("kakao")
+
+				if len(generated.Result.Labels) > 0 {
+					tags := []string{}
+					for i := 0; i < len(generated.Result.Labels); i++ {
+						tags = append(tags, fmt.Sprintf("%s (%s)", generated.Result.Labels[i], generated.Result.LabelsKorean[i]))
+					}
+
+					// send tags
+					message := fmt.Sprintf("%s:\n\n%s", title(len(tags), generated.Result.Labels), strings.Join(tags, "\n"))
+					summary = message
+
+					// or, formatted one
+					options := messageOptions(job.replyToMessageID)
+					if conf.FormatTextResults {
+						lines := []string{}
+						for i := 0; i < len(generated.Result.Labels); i++ {
+							lines = append(lines, fmt.Sprintf("*%s* \\(%s\\)", escapeMarkdownV2(generated.Result.Labels[i]), escapeMarkdownV2(generated.Result.LabelsKorean[i])))
+						}
+						message = fmt.Sprintf("*%s:*\n\n%s", escapeMarkdownV2(title(len(tags), generated.Result.Labels)), strings.Join(lines, "\n"))
+						options.SetParseMode(bot.ParseModeMarkdownV2)
+					}
+
+					if sent := withResultTTL(b, sendMessage(b, chatID, message, options)); !sent.Ok {
+						errorMessage = fmt.Sprintf("Failed to send tags: %s", *sent.Description)
+					}
+				} else {
+					errorMessage = "Could not tag given image."
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to tag image: %s", err)
+			}
+		case AnalyzePoses, PoseSilhouette:
+			var analyzed kakaoapi.ResponseAnalyzedPose
+			if conf.MirrorPoses {
+				analyzed, err = analyzeMirroredPoses(kakaoClient, correlationID, imgBytes)
+			} else {
+				analyzed, err = kakaoClient.AnalyzePoseFromBytes(imgBytes)
+			}
+			timer.mark("kakao")
+			if err == nil {
+				summary = fmt.Sprintf("%d pose(s) analyzed", len(analyzed))
+
+				var img image.Image
+				img, err = decodeImage(correlationID, imgBytes)
+				if err == nil {
+					var newImg image.Image
+					if command == PoseSilhouette {
+						newImg = processImageForPoseSilhouette(img, analyzed, palette)
+					} else {
+						newImg = processImageForPoses(img, analyzed, palette)
+					}
+					timer.mark("draw")
+
+					// send a photo with lines drawn on poses
+					resultBytes, errorMessage = sendResultImage(b, chatID, job.replyToMessageID, newImg, title(len(analyzed), nil))
+				} else {
+					errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect faces: %s", err)
+			}
+		case NSFWHeatmap:
+			var detected kakaoapi.ResponseDetectedNSFW
+			var img image.Image
+			var tiles []nsfwTile
+			if detected, err = kakaoClient.DetectNSFWFromBytes(imgBytes); err == nil {
+				if img, err = decodeImage(correlationID, imgBytes); err == nil {
+					tiles, err = scoreNSFWTiles(kakaoClient, img)
+				} else {
+					err = fmt.Errorf("failed to decode image: %s", err)
+				}
+			}
+			timer.mark("kakao")
+			if err == nil {
+				flagged := 0
+				for _, tile := range tiles {
+					if tile.score > NSFWTileFlagThreshold {
+						flagged++
+					}
+				}
+				summary = fmt.Sprintf("Normal: %.2f%%, Soft: %.2f%%, Adult: %.2f%% (%d of %d tile(s) flagged)",
+					100.0*detected.Result.Normal,
+					100.0*detected.Result.Soft,
+					100.0*detected.Result.Adult,
+					flagged,
+					len(tiles),
+				)
+
+				// overlay scores of tiles
+				newImg := drawNSFWHeatmap(img, tiles)
+				timer.mark("draw")
+
+				// send a photo with the heatmap of tiles, and the decision of the whole image
+				resultBytes, errorMessage = sendResultImage(b, chatID, job.replyToMessageID, newImg, fmt.Sprintf("%s:\n\n%s", title(flagged, nil), summary))
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect NSFW factors from image: %s", err)
+			}
+		case DebugGrid:
+			var faces kakaoapi.ResponseDetectedFace
+			var skipped int
+			var products kakaoapi.ResponseDetectedProduct
+			if faces, skipped, err = detectFaces(kakaoClient, imgBytes, 0.7); err == nil {
+				products, err = kakaoClient.DetectProductFromBytes(imgBytes, conf.ProductDetectionThreshold)
+			}
+			timer.mark("kakao")
+			if err == nil {
+				// normalized coordinates of detected faces and products
+				lines := []string{}
+				for i, f := range faces.Result.Faces {
+					lines = append(lines, fmt.Sprintf("face #%d: (%.3f, %.3f) - (%.3f, %.3f)", i+1, f.X, f.Y, f.X+f.W, f.Y+f.H))
+				}
+				for i, o := range products.Result.Objects {
+					lines = append(lines, fmt.Sprintf("product #%d (%s): (%.3f, %.3f) - (%.3f, %.3f)", i+1, o.Class, o.X1, o.Y1, o.X2, o.Y2))
+				}
+				if len(lines) <= 0 {
+					lines = append(lines, "(nothing detected)")
+				}
+				summary = strings.Join(lines, "\n")
+
+				var img image.Image
+				img, err = decodeImage(correlationID, imgBytes)
+				if err == nil {
+					// draw boxes on faces and products, then the grid over them
+					annotated, _ := processImageForProducts(processImageForFaces(img, faces, DetectFaces, "", palette), products, palette)
+					newImg := drawDebugGrid(annotated)
+					timer.mark("draw")
+
+					// send a photo with the grid, then the coordinates
+					if resultBytes, errorMessage = sendResultImage(b, chatID, job.replyToMessageID, newImg, fmt.Sprintf("%s (%dx%d)%s", title(len(faces.Result.Faces)+len(products.Result.Objects), nil), faces.Result.Width, faces.Result.Height, skippedSmallFacesNote(skipped))); errorMessage == "" {
+						if sent := withResultTTL(b, sendMessage(b, chatID, summary, messageOptions(job.replyToMessageID))); !sent.Ok {
+							errorMessage = fmt.Sprintf("Failed to send coordinates: %s", *sent.Description)
+						}
+					}
+				} else {
+					errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect faces and products: %s", err)
+			}
+		case CompareThresholds:
+			var img image.Image
+			img, err = decodeImage(correlationID, imgBytes)
+			if err == nil {
+				// detect faces with each threshold
+				imgs := []image.Image{}
+				captions := []string{}
+				counts := []string{}
+				for _, threshold := range compareThresholds {
+					var detected kakaoapi.ResponseDetectedFace
+					var skipped int
+					if detected, skipped, err = detectFaces(kakaoClient, imgBytes, threshold); err != nil {
+						break
+					}
+
+					imgs = append(imgs, processImageForFaces(img, detected, DetectFaces, "", palette))
+					captions = append(captions, fmt.Sprintf("Threshold %.1f: %d face(s)%s", threshold, len(detected.Result.Faces), skippedSmallFacesNote(skipped)))
+					counts = append(counts, fmt.Sprintf("%.1f=%d", threshold, len(detected.Result.Faces)))
+				}
+				timer.mark("kakao")
+
+				if err == nil {
+					summary = strings.Join(counts, ", ")
+
+					// 'uploading photo...'
+					b.SendChatAction(chatID, bot.ChatActionUploadPhoto)
+
+					// send annotated images as a media group
+					if err = sendImagesAsMediaGroups(b, chatID, job.replyToMessageID, imgs, captions); err != nil {
+						errorMessage = fmt.Sprintf("Failed to send images: %s", err)
+					}
+				} else {
+					errorMessage = fmt.Sprintf("Failed to detect faces: %s", err)
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+			}
+		case AnalyzeColors:
+			var img image.Image
+			img, err = decodeImage(correlationID, imgBytes)
+			if err == nil {
+				colors := dominantColors(img, DominantColorsCount)
+				timer.mark("draw")
+
+				lines := []string{}
+				for _, c := range colors {
+					lines = append(lines, fmt.Sprintf("#%02x%02x%02x (%.1f%%)", c.color.R, c.color.G, c.color.B, 100.0*c.ratio))
+				}
+				summary = strings.Join(lines, "\n")
+
+				// send color swatches with their hex codes
+				resultBytes, errorMessage = sendResultImage(b, chatID, job.replyToMessageID, colorSwatches(colors), fmt.Sprintf("%s:\n\n%s", title(len(colors), nil), summary))
+			} else {
+				errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+			}
+		case ExtractTexts:
+			var detected kakaoapi.ResponseDetectedText
+
+			// NOTE: kakao's ocr api accepts no language hint, only the image
+			// (https://developers.kakao.com/docs/latest/ko/vision/dev-guide#ocr)
+			detected, err = kakaoClient.DetectTextFromBytes(imgBytes)
+			timer.mark("kakao")
+
+			// sort texts in reading order
+			if err == nil && !conf.OCRRawOrder {
+				detected = sortTextsInReadingOrder(detected)
+			}
+			if err == nil && conf.ExtractTextsAsImage {
+				var img image.Image
+				img, err = decodeImage(correlationID, imgBytes)
+				if err == nil {
+					newImg, lines := processImageForTexts(img, detected, palette)
+					timer.mark("draw")
+
+					summary = strings.Join(lines, "\n")
+
+					// send a photo with numbered polygons drawn on texts, then the numbered texts
+					if resultBytes, errorMessage = sendResultImage(b, chatID, job.replyToMessageID, newImg, title(len(lines), nil)); errorMessage == "" && len(lines) > 0 {
+						if sent := withResultTTL(b, sendPaginatedTexts(b, chatID, "", lines, "\n", false, messageOptions(job.replyToMessageID))); !sent.Ok {
+							errorMessage = fmt.Sprintf("Failed to send extracted texts: %s", *sent.Description)
+						}
+					}
+				} else {
+					errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+				}
+			} else if err == nil {
+				strs := []string{}
+				for _, result := range detected.Result {
+					strs = append(strs, result.RecognizedWords...)
+				}
+
+				message := fmt.Sprintf(`%s:
+
+%s`,
+					title(len(strs), nil),
+					strings.Join(strs, ", "),
+				)
+				summary = message
+
+				// (long ones are paginated)
+				header, words := fmt.Sprintf("%s:", title(len(strs), nil)), strs
+
+				// or, formatted one
+				if conf.FormatTextResults {
+					words = []string{}
+					for _, str := range strs {
+						words = append(words, fmt.Sprintf("`%s`", escapeMarkdownV2Code(str)))
+					}
+					header = fmt.Sprintf("*%s:*", escapeMarkdownV2(title(len(strs), nil)))
+				}
+
+				if sent := withResultTTL(b, sendPaginatedTexts(b, chatID, header, words, ", ", conf.FormatTextResults, messageOptions(job.replyToMessageID))); !sent.Ok {
+					errorMessage = fmt.Sprintf("Failed to send extracted texts: %s", *sent.Description)
+				}
+			} else {
+				errorMessage = fmt.Sprintf("Failed to detect texts: %s", err)
+			}
+		default:
+			errorMessage = fmt.Sprintf("Command not supported: %s", command)
+		}
+	} else if notAnImage, ok := err.(errNotAnImage); ok {
+		errorMessage = fmt.Sprintf(messageNotAnImage, notAnImage.contentType)
+	} else if unreadable, ok := err.(errUnreadablePDF); ok {
+		if unreadable.err == errNoImageInPDF {
+			errorMessage = messageNoImageInPDF
+		} else {
+			errorMessage = fmt.Sprintf(messageUnreadablePDF, unreadable.err)
+		}
+	} else {
+		errorMessage = fmt.Sprintf("Failed to read file from %s: %s", job.fileURL, err)
+	}
+
+	timer.mark("send")
+
+	// acknowledge in the sender's chat, where statuses, errors, and reactions go
+	if chatID != job.chatID {
+		if errorMessage == "" {
+			sendMessage(b, job.chatID, fmt.Sprintf(messageResultRouted, command), messageOptions(replyToMessageID))
+		}
+
+		chatID, job.replyToMessageID = job.chatID, replyToMessageID
+	}
+
+	// delete original message (or mark it as done)
+	stopSpinner()
+	if conf.KeepStatusMessage {
+		status := fmt.Sprintf(messageDone, command)
+		if err != nil || errorMessage != "" {
+			status = fmt.Sprintf(messageFailed, command)
+		}
+		b.EditMessageText(status, bot.OptionsEditMessageText{}.SetIDs(chatID, job.messageIDToDelete))
+	} else {
+		b.DeleteMessage(chatID, job.messageIDToDelete)
+	}
+
+	// log time taken by each step
+	logVerbose(fmt.Sprintf("[%s] Latencies of '%s': %s", correlationID, command, timer))
+
+	// if there was any error, send it back
+	if errorMessage != "" {
+		options := messageOptions(job.replyToMessageID)
+		if retry := retryCallbackData(job); retry != "" {
+			options.SetReplyMarkup(bot.InlineKeyboardMarkup{
+				InlineKeyboard: [][]bot.InlineKeyboardButton{
+					{{Text: messageRetry, CallbackData: &retry}},
+				},
+			})
+		}
+		sendMessage(b, chatID, fmt.Sprintf("%s\n\n(request id: %s)", errorMessage, correlationID), options)
+
+		logError(fmt.Sprintf("[%s] %s", correlationID, errorMessage))
+	} else {
+		if job.forwardedFrom != "" {
+			logMessage(fmt.Sprintf("[%s] Processed '%s' (forwarded from %s)", correlationID, command, job.forwardedFrom))
+		} else {
+			logMessage(fmt.Sprintf("[%s] Processed '%s'", correlationID, command))
+		}
+	}
+
+	// send the action keyboard again, for running other commands on the same image
+	if conf.KeepKeyboard {
+		if sent := sendMessage(
+			b,
+			chatID,
+			messageActionImage,
+			messageOptions(job.replyToMessageID).SetReplyMarkup(bot.InlineKeyboardMarkup{
+				InlineKeyboard: genImageInlineKeyboards(chatID, job.fileID, job.languageCode),
+			}),
+		); !sent.Ok {
+			logError(fmt.Sprintf("[%s] Failed to send action keyboard again: %s", correlationID, *sent.Description))
+		}
+	}
+
+	// react to the original image message with the result
+	if conf.ReactToResults && job.replyToMessageID != 0 {
+		emoji := reactionSucceeded
+		if err != nil || errorMessage != "" {
+			emoji = reactionFailed
+		}
+		if err := setMessageReaction(chatID, job.replyToMessageID, emoji); err != nil {
+			logError(fmt.Sprintf("[%s] Failed to set reaction: %s", correlationID, err))
+		}
+	}
+
+	// report the result to the webhook
+	if conf.ResultWebhookURL != "" {
+		payload := resultWebhookPayload{
+			CorrelationID: correlationID,
+			Username:      job.username,
+			ChatID:        chatID,
+			Command:       command,
+			Success:       err == nil && errorMessage == "",
+			Error:         errorMessage,
+			Summary:       summary,
+		}
+		if payload.Success && len(resultBytes) > 0 {
+			payload.Image = base64.StdEncoding.EncodeToString(resultBytes)
+		}
+
+		go postResultWebhook(payload)
+	}
+}
+
+// payload for the result webhook
+type resultWebhookPayload struct {
+	CorrelationID string        `json:"correlation_id"`
+	Username      string        `json:"username"`
+	ChatID        int64         `json:"chat_id"`
+	Command       VisionCommand `json:"command"`
+	Success       bool          `json:"success"`
+	Error         string        `json:"error,omitempty"`
+	Summary       string        `json:"summary,omitempty"`
+	Image         string        `json:"image,omitempty"` // base64-encoded result image
+}
+
+// post given payload to the result webhook
+//
+// (failures are only logged, so that they never affect replies to users)
+func postResultWebhook(payload resultWebhookPayload) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		logError(fmt.Sprintf("[%s] Failed to encode webhook payload: %s", payload.CorrelationID, err))
+		return
+	}
+
+	response, err := resultWebhookHTTPClient.Post(conf.ResultWebhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		logError(fmt.Sprintf("[%s] Failed to post result to webhook: %s", payload.CorrelationID, err))
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		logError(fmt.Sprintf("[%s] Failed to post result to webhook: HTTP status %d", payload.CorrelationID, response.StatusCode))
+	}
+}
+
+// timer for measuring time taken by each step of a request
+type stepTimer struct {
+	start, last time.Time
+	steps       []string
+}
+
+// new timer starting from now
+func newStepTimer() *stepTimer {
+	now := time.Now()
+
+	return &stepTimer{start: now, last: now}
+}
+
+// record time taken since the last mark as given step
+func (t *stepTimer) mark(step string) {
+	now := time.Now()
+	t.steps = append(t.steps, fmt.Sprintf("%s=%s", step, now.Sub(t.last).Round(time.Millisecond)))
+	t.last = now
+}
+
+// time taken by each step and in total
+func (t *stepTimer) String() string {
+	return strings.Join(append(t.steps, fmt.Sprintf("total=%s", t.last.Sub(t.start).Round(time.Millisecond))), ", ")
+}
+
+// escape special characters of MarkdownV2
+//
+// https://core.telegram.org/bots/api#markdownv2-style
+func escapeMarkdownV2(str string) string {
+	return markdownV2Escaper.Replace(str)
+}
+
+// escape special characters inside code (`...`) of MarkdownV2
+func escapeMarkdownV2Code(str string) string {
+	return markdownV2CodeEscaper.Replace(str)
+}
+
+var markdownV2Escaper = strings.NewReplacer(
+	"\\", "\\\\", "_", "\\_", "*", "\\*", "[", "\\[", "]", "\\]", "(", "\\(", ")", "\\)",
+	"~", "\\~", "`", "\\`", ">", "\\>", "#", "\\#", "+", "\\+", "-", "\\-", "=", "\\=",
+	"|", "\\|", "{", "\\{", "}", "\\}", ".", "\\.", "!", "\\!",
+)
+var markdownV2CodeEscaper = strings.NewReplacer("\\", "\\\\", "`", "\\`")
+
+// count of a product class
+type classCount struct {
+	class string
+	count int
+}
+
+// count detected products by their classes (sorted by count in descending order)
+func countProductClasses(detected kakaoapi.ResponseDetectedProduct) []classCount {
+	counts := map[string]int{}
+	for _, o := range detected.Result.Objects {
+		counts[o.Class]++
+	}
+
+	result := []classCount{}
+	for class, count := range counts {
+		result = append(result, classCount{class: class, count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].count == result[j].count {
+			return result[i].class < result[j].class
+		}
+		return result[i].count > result[j].count
+	})
+
+	return result
+}
+
+// remove products which overlap with others more than `product-nms-iou-threshold` (non-maximum suppression)
+//
+// (as the api returns no per-object scores, larger ones are kept; returns the number of removed ones)
+func suppressOverlappingProducts(detected kakaoapi.ResponseDetectedProduct) (kakaoapi.ResponseDetectedProduct, int) {
+	objects := detected.Result.Objects
+	if conf.ProductNMSIoUThreshold <= 0 || len(objects) < 2 {
+		return detected, 0
+	}
+
+	// larger ones first
+	area := func(i int) float64 {
+		return (objects[i].X2 - objects[i].X1) * (objects[i].Y2 - objects[i].Y1)
+	}
+	order := []int{}
+	for i := range objects {
+		order = append(order, i)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return area(order[i]) > area(order[j])
+	})
+
+	kept := []int{}
+	for _, i := range order {
+		overlapping := false
+		for _, k := range kept {
+			if intersectionOverUnion(
+				objects[i].X1, objects[i].Y1, objects[i].X2, objects[i].Y2,
+				objects[k].X1, objects[k].Y1, objects[k].X2, objects[k].Y2,
+			) > conf.ProductNMSIoUThreshold {
+				overlapping = true
+				break
+			}
+		}
+		if !overlapping {
+			kept = append(kept, i)
+		}
+	}
+
+	// keep the original order
+	sort.Ints(kept)
+	filtered := objects[:0:0]
+	for _, i := range kept {
+		filtered = append(filtered, objects[i])
+	}
+	detected.Result.Objects = filtered
+
+	return detected, len(objects) - len(filtered)
+}
+
+// remove detected products which overlap with detected faces more than `face-product-iou-threshold`
+//
+// (for Detect All, where a face can also be detected as a product)
+func suppressProductsOverlappingFaces(products kakaoapi.ResponseDetectedProduct, faces kakaoapi.ResponseDetectedFace) (kakaoapi.ResponseDetectedProduct, int) {
+	objects := products.Result.Objects
+	if conf.FaceProductIoUThreshold <= 0 || len(objects) <= 0 || len(faces.Result.Faces) <= 0 {
+		return products, 0
+	}
+
+	filtered := objects[:0:0]
+	for _, o := range objects {
+		overlapping := false
+		for _, f := range faces.Result.Faces {
+			if intersectionOverUnion(
+				o.X1, o.Y1, o.X2, o.Y2,
+				f.X, f.Y, f.X+f.W, f.Y+f.H,
+			) > conf.FaceProductIoUThreshold {
+				overlapping = true
+				break
+			}
+		}
+		if !overlapping {
+			filtered = append(filtered, o)
+		}
+	}
+	products.Result.Objects = filtered
+
+	return products, len(objects) - len(filtered)
+}
+
+// remove detected faces whose width or height (relative to the image) is smaller than `min-face-fraction`
+//
+// (for not cluttering results with tiny faces in the background)
+func skipSmallFaces(detected kakaoapi.ResponseDetectedFace) (kakaoapi.ResponseDetectedFace, int) {
+	faces := detected.Result.Faces
+	if conf.MinFaceFraction <= 0 || len(faces) <= 0 {
+		return detected, 0
+	}
+
+	filtered := faces[:0:0]
+	for _, f := range faces {
+		if f.W >= conf.MinFaceFraction && f.H >= conf.MinFaceFraction {
+			filtered = append(filtered, f)
+		}
+	}
+	detected.Result.Faces = filtered
+
+	return detected, len(faces) - len(filtered)
+}
+
+// detect faces from given image bytes, and skip small ones with `min-face-fraction` (returns the number of skipped faces)
+//
+// (every command which consumes detected faces should use this, for skipping them consistently)
+func detectFaces(kakaoClient timedKakaoClient, imgBytes []byte, threshold float32) (detected kakaoapi.ResponseDetectedFace, skipped int, err error) {
+	if detected, err = kakaoClient.DetectFaceFromBytes(imgBytes, threshold); err == nil {
+		detected, skipped = skipSmallFaces(detected)
+	}
+
+	return detected, skipped, err
+}
+
+// note about skipped small faces (empty if none)
+func skippedSmallFacesNote(skipped int) string {
+	if skipped <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("\n\n(%d small face(s) skipped)", skipped)
+}
+
+// intersection over union of two boxes
+func intersectionOverUnion(ax1, ay1, ax2, ay2, bx1, by1, bx2, by2 float64) float64 {
+	w := math.Min(ax2, bx2) - math.Max(ax1, bx1)
+	h := math.Min(ay2, by2) - math.Max(ay1, by1)
+	if w <= 0 || h <= 0 {
+		return 0
+	}
+
+	intersection := w * h
+	union := (ax2-ax1)*(ay2-ay1) + (bx2-bx1)*(by2-by1) - intersection
+	if union <= 0 {
+		return 0
+	}
+
+	return intersection / union
+}
+
+// note about removed overlapping products (empty if none)
+func suppressedProductsNote(suppressed int) string {
+	if suppressed <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("\n\n(%d overlapping product(s) removed)", suppressed)
+}
+
+// detected region (in pixels) for reporting
+type detection struct {
+	class      string
+	x, y, w, h int
+	score      float64
+	hasScore   bool
+}
+
+// detections from detected faces
+func faceDetections(detected kakaoapi.ResponseDetectedFace) []detection {
+	width, height := float64(detected.Result.Width), float64(detected.Result.Height)
+
+	detections := []detection{}
+	for _, f := range detected.Result.Faces {
+		detections = append(detections, detection{
+			class:    "face",
+			x:        int(width * f.X),
+			y:        int(height * f.Y),
+			w:        int(width * f.W),
+			h:        int(height * f.H),
+			score:    f.Score,
+			hasScore: true,
+		})
+	}
+
+	return detections
+}
+
+// detections from detected products
+func productDetections(detected kakaoapi.ResponseDetectedProduct) []detection {
+	width, height := float64(detected.Result.Width), float64(detected.Result.Height)
+
+	detections := []detection{}
+	for _, o := range detected.Result.Objects {
+		detections = append(detections, detection{
+			class: o.Class,
+			x:     int(width * o.X1),
+			y:     int(height * o.Y1),
+			w:     int(width * (o.X2 - o.X1)),
+			h:     int(height * (o.Y2 - o.Y1)),
+		})
+	}
+
+	return detections
+}
+
+// write given detections as CSV (with image dimensions on each row)
+func writeDetectionsCSV(w io.Writer, width, height int, detections []detection) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"index", "class", "x", "y", "w", "h", "score", "image_width", "image_height"}); err != nil {
+		return err
+	}
+	for i, d := range detections {
+		score := ""
+		if d.hasScore {
+			score = strconv.FormatFloat(d.score, 'f', 4, 64)
+		}
+
+		if err := writer.Write([]string{
+			strconv.Itoa(i + 1),
+			d.class,
+			strconv.Itoa(d.x),
+			strconv.Itoa(d.y),
+			strconv.Itoa(d.w),
+			strconv.Itoa(d.h),
+			score,
+			strconv.Itoa(width),
+			strconv.Itoa(height),
+		}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// send given detections as a CSV document
+func sendDetectionsCSV(b *bot.Bot, chatID, replyToMessageID int64, width, height int, detections []detection) error {
+	buf := new(bytes.Buffer)
+	if err := writeDetectionsCSV(buf, width, height, detections); err != nil {
+		return err
+	}
+
+	return sendDocument(b, chatID, replyToMessageID, "detections-*.csv", buf.Bytes(), "")
+}
+
+// send the result image of given command with its text report and detections (as CSV) in a zip archive (with given caption)
+func sendResultArchive(b *bot.Bot, chatID, replyToMessageID int64, command VisionCommand, imgBytes []byte, report, caption string, width, height int, detections []detection) error {
+	csvBuf := new(bytes.Buffer)
+	if err := writeDetectionsCSV(csvBuf, width, height, detections); err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	writer := zip.NewWriter(buf)
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{allCmds[command] + ".jpg", imgBytes},
+		{"report.txt", []byte(report + "\n")},
+		{"detections.csv", csvBuf.Bytes()},
+	} {
+		entry, err := writer.Create(file.name)
+		if err != nil {
+			return fmt.Errorf("failed to create archive entry: %s", err)
+		}
+		if _, err := entry.Write(file.data); err != nil {
+			return fmt.Errorf("failed to write archive entry: %s", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to close archive: %s", err)
+	}
+
+	return sendDocument(b, chatID, replyToMessageID, allCmds[command]+"-*.zip", buf.Bytes(), caption)
+}
+
+// send given bytes as a document
+//
+// (written to a temporary file, so that the document has a proper filename)
+func sendDocument(b *bot.Bot, chatID, replyToMessageID int64, filenamePattern string, data []byte, caption string) error {
+	file, err := ioutil.TempFile("", filenamePattern)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	options := bot.OptionsSendDocument{}
+	if replyToMessageID != 0 {
+		options.SetReplyToMessageID(replyToMessageID).SetAllowSendingWithoutReply(true)
+	}
+	if caption != "" {
+		options.SetCaption(caption)
+	}
+	for attempt := 0; ; attempt++ {
+		sent := b.SendDocument(chatID, bot.InputFileFromFilepath(file.Name()), options)
+		if sent.Ok {
+			withResultTTL(b, sent)
+
+			return nil
+		} else if !waitForRetryAfter(sent.APIResponseBase, attempt) {
+			return fmt.Errorf("%s", *sent.Description)
+		}
+	}
+}
+
+// generate a text report of detected products (numbered as drawn on the image)
+func productsReport(title string, classes []string) string {
+	lines := []string{}
+	for i, class := range classes {
+		lines = append(lines, fmt.Sprintf("#%d: %s", i+1, class))
+	}
+
+	return fmt.Sprintf("%s:\n\n%s", title, strings.Join(lines, "\n"))
+}
+
+// generate a short random id for correlating logs of a request
+func newCorrelationID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff) // fallback
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// shorten given file id for fitting in callback data, and remember it
+func shortenFileID(fileID string) string {
+	shortenedFileID := fileID[:32]
+	fileIDsLock.Lock()
+	fileIDs[shortenedFileID] = fileID
+	fileIDsLock.Unlock()
+
+	return shortenedFileID
+}
+
+// callback data for retrying given (failed) job, empty if it cannot be retried
+//
+// (callback data: `retry/COMMAND/SHORTENED_FILE_ID[/STYLE]`)
+func retryCallbackData(job imageJob) string {
+	cmd, exists := allCmds[job.command]
+	if !exists || len(job.fileID) < 32 {
+		return ""
+	}
+
+	data := fmt.Sprintf("%s/%s/%s", commandRetry, cmd, shortenFileID(job.fileID))
+	if job.maskStyle != "" {
+		data += "/" + job.maskStyle
+	}
+	if len(data) > 64 { // max length of callback data
+		return ""
+	}
+	return data
+}
+
+// generate inline keyboards for selecting action
+func genImageInlineKeyboards(chatID int64, fileID, languageCode string) [][]bot.InlineKeyboardButton {
+	shortenedFileID := shortenFileID(fileID)
+
+	data := map[string]string{}
+	for title, cmd := range allCmds {
+		if !isCommandAllowed(chatID, title) {
+			continue
+		}
+
+		data[localizedCommand(languageCode, title)] = fmt.Sprintf("%s/%s", cmd, shortenedFileID)
+	}
+
+	cancel := commandCancel
+	return append(bot.NewInlineKeyboardButtonsAsRowsWithCallbackData(data), []bot.InlineKeyboardButton{
+		{Text: strings.Title(commandCancel), CallbackData: &cancel},
+	})
+}
+
+// generate inline keyboards for choosing masking style of given command and (shortened) file id
+//
+// (callback data: `COMMAND/SHORTENED_FILE_ID/STYLE`)
+func genMaskStyleInlineKeyboards(command, shortenedFileID string) [][]bot.InlineKeyboardButton {
+	buttons := []bot.InlineKeyboardButton{}
+	for _, style := range maskStyles {
+		data := fmt.Sprintf("%s/%s/%s", command, shortenedFileID, style)
+		buttons = append(buttons, bot.InlineKeyboardButton{Text: strings.Title(style), CallbackData: &data})
+	}
+
+	cancel := commandCancel
+	return [][]bot.InlineKeyboardButton{
+		buttons,
+		{{Text: strings.Title(commandCancel), CallbackData: &cancel}},
+	}
+}
+
+// masking style in given (parsed) callback data, pixelate if missing or unknown
+func maskStyleOf(parsedCommand []string) string {
+	if len(parsedCommand) >= 3 {
+		for _, style := range maskStyles {
+			if parsedCommand[2] == style {
+				return style
+			}
+		}
+	}
+	return maskStylePixelate
+}
+
+// chat where results of images from given chat are sent (given chat itself if not routed)
+func resultChatFor(chatID int64) int64 {
+	if destination, exists := conf.ResultChatRoutes[strconv.FormatInt(chatID, 10)]; exists {
+		return destination
+	}
+	return chatID
+}
+
+// check if given chat is one of `admin-chat-ids`
+func isAdminChat(chatID int64) bool {
+	for _, id := range conf.AdminChatIDs {
+		if id == chatID {
+			return true
+		}
+	}
+	return false
+}
+
+// check if given command is allowed in given chat
+func isCommandAllowed(chatID int64, command VisionCommand) bool {
+	return !adminCmds[command] || isAdminChat(chatID)
+}
+
+// draw given label as a filled badge at the configured corner of given box
+func drawBadge(img *image.RGBA, label string, c color.RGBA, x1, y1, x2, y2 float64) {
+	fontSize := float64(img.Bounds().Dy()) / 32.0
+
+	// measure label
+	face := truetype.NewFace(font, &truetype.Options{Size: fontSize, DPI: 72})
+	defer face.Close()
+	textWidth := xfont.MeasureString(face, label).Ceil()
+	metrics := face.Metrics()
+	ascent, descent := metrics.Ascent.Ceil(), metrics.Descent.Ceil()
+	badgeWidth, badgeHeight := textWidth+BadgePadding*2, ascent+descent+BadgePadding*2
+
+	// position badge outside of the box, at the selected corner
+	var x, y int
+	switch conf.BadgeCorner {
+	case badgeCornerTopRight:
+		x, y = int(x2)-badgeWidth, int(y1)-badgeHeight
+	case badgeCornerBottomLeft:
+		x, y = int(x1), int(y2)
+	case badgeCornerBottomRight:
+		x, y = int(x2)-badgeWidth, int(y2)
+	default: // top-left
+		x, y = int(x1), int(y1)-badgeHeight
+	}
+
+	// keep it in the image
+	bounds := img.Bounds()
+	if x+badgeWidth > bounds.Max.X {
+		x = bounds.Max.X - badgeWidth
+	}
+	if x < bounds.Min.X {
+		x = bounds.Min.X
+	}
+	if y+badgeHeight > bounds.Max.Y {
+		y = bounds.Max.Y - badgeHeight
+	}
+	if y < bounds.Min.Y {
+		y = bounds.Min.Y
+	}
+
+	// fill badge
+	badge := image.Rect(x, y, x+badgeWidth, y+badgeHeight)
+	draw.Draw(img, badge, &image.Uniform{c}, image.ZP, draw.Src)
+
+	// draw label with contrasting color
+	fc := freetype.NewContext()
+	fc.SetFont(font)
+	fc.SetDPI(72)
+	fc.SetClip(bounds)
+	fc.SetDst(img)
+	fc.SetFontSize(fontSize)
+	fc.SetSrc(&image.Uniform{contrastingColor(c)})
+	if _, err := fc.DrawString(label, freetype.Pt(x+BadgePadding, y+BadgePadding+ascent)); err != nil {
+		logError(fmt.Sprintf("Failed to draw badge string: %s", err))
+	}
+}
 
-Normal: %.2f%%
-Soft: %.2f%%
-Adult: %.2f%%`,
-					command,
-					100.0*detected.Result.Normal,
-					100.0*detected.Result.Soft,
-					100.0*detected.Result.Adult,
-				)
-				if sent := b.SendMessage(chatID, message, nil); !sent.Ok {
-					errorMessage = fmt.Sprintf("Failed to send nsfw factors: %s", *sent.Description)
-				}
-			} else {
-				errorMessage = fmt.Sprintf("Failed to detect NSFW factors from image: %s", err)
+// resize, watermark, and encode given result image for sending it
+func finishResult(img image.Image) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := encodeResult(buf, drawWatermark(resizeResult(img))); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// send given result image (finished with `finishResult`) as a photo with caption
+//
+// (returns the encoded image for the result webhook, and an error message for the user if it failed)
+func sendResultImage(b *bot.Bot, chatID, replyToMessageID int64, img image.Image, caption string) (resultBytes []byte, errorMessage string) {
+	// 'uploading photo...'
+	b.SendChatAction(chatID, bot.ChatActionUploadPhoto)
+
+	resultBytes, err := finishResult(img)
+	if err != nil {
+		return nil, fmt.Sprintf("Failed to encode image: %s", err)
+	}
+
+	options := photoOptions(replyToMessageID)
+	if caption != "" {
+		options.SetCaption(caption)
+	}
+	if sent := withResultTTL(b, sendPhoto(b, chatID, bot.InputFileFromBytes(resultBytes), options)); !sent.Ok {
+		return resultBytes, fmt.Sprintf("Failed to send image: %s", *sent.Description)
+	}
+
+	return resultBytes, ""
+}
+
+// send given result image (finished with `finishResult`) with its text report and detections in a zip archive
+//
+// (returns the encoded image for the result webhook, and an error message for the user if it failed)
+func sendResultImageArchive(b *bot.Bot, chatID, replyToMessageID int64, command VisionCommand, img image.Image, report, caption string, width, height int, detections []detection) (resultBytes []byte, errorMessage string) {
+	// 'sending file...'
+	b.SendChatAction(chatID, bot.ChatActionUploadDocument)
+
+	resultBytes, err := finishResult(img)
+	if err != nil {
+		return nil, fmt.Sprintf("Failed to encode image: %s", err)
+	}
+
+	if err := sendResultArchive(b, chatID, replyToMessageID, command, resultBytes, report, caption, width, height, detections); err != nil {
+		return resultBytes, fmt.Sprintf("Failed to send archive: %s", err)
+	}
+
+	return resultBytes, ""
+}
+
+// encode given result image as jpeg, lowering its quality (then downscaling it) until it fits in `max-result-bytes`
+//
+// NOTE: results are kept in jpeg; the only pure-go webp encoder (needed for CGO_ENABLED=0 builds) is lossless-only
+// and requires go 1.22, and its lossless output was about 3x larger than jpeg for annotated photos
+func encodeResult(buf *bytes.Buffer, img image.Image) error {
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		return err
+	}
+	if buf.Len() <= conf.MaxResultBytes {
+		return nil
+	}
+
+	original := buf.Len()
+	quality := jpeg.DefaultQuality
+	for step := 0; step < RecompressionMaxSteps && buf.Len() > conf.MaxResultBytes; step++ {
+		if step < RecompressionQualities {
+			// lower quality first,
+			quality -= (jpeg.DefaultQuality - RecompressionMinQuality) / RecompressionQualities
+		} else {
+			// then downscale
+			bounds := img.Bounds()
+			g := gift.New(gift.Resize(int(float64(bounds.Dx())*RecompressionScale), 0, gift.LinearResampling))
+			resized := image.NewRGBA(g.Bounds(bounds))
+			g.Draw(resized, img)
+			img = resized
+		}
+
+		buf.Reset()
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return err
+		}
+	}
+
+	logMessage(fmt.Sprintf("Recompressed result image: %d -> %d bytes (quality: %d, size: %dx%d)", original, buf.Len(), quality, img.Bounds().Dx(), img.Bounds().Dy()))
+
+	if buf.Len() > conf.MaxResultBytes {
+		return fmt.Errorf("result image too large (%d bytes, over %d bytes)", buf.Len(), conf.MaxResultBytes)
+	}
+	return nil
+}
+
+// downscale given result image to fit in the configured resolution (never upscaled)
+func resizeResult(img image.Image) image.Image {
+	size, exists := resultResolutionSizes[conf.ResultResolution]
+	if !exists {
+		return img
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() <= size && bounds.Dy() <= size {
+		return img
+	}
+
+	g := gift.New(gift.ResizeToFit(size, size, gift.LanczosResampling))
+	resized := image.NewRGBA(g.Bounds(bounds))
+	g.Draw(resized, img)
+
+	return resized
+}
+
+// draw the watermark text (if enabled) at the configured corner of given image
+func drawWatermark(img image.Image) image.Image {
+	text := conf.WatermarkText
+	if text == "" && botUsername != "" {
+		text = "@" + botUsername
+	}
+	if !conf.Watermark || text == "" {
+		return img
+	}
+
+	bounds := img.Bounds()
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(bounds)
+		draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+	}
+
+	fontSize := math.Max(float64(bounds.Dy())/40.0, 10.0)
+
+	// measure text
+	face := truetype.NewFace(font, &truetype.Options{Size: fontSize, DPI: 72})
+	defer face.Close()
+	textWidth := xfont.MeasureString(face, text).Ceil()
+	metrics := face.Metrics()
+	ascent, descent := metrics.Ascent.Ceil(), metrics.Descent.Ceil()
+
+	// position text at the selected corner
+	margin := BadgePadding * 2
+	var x, y int // baseline
+	switch conf.WatermarkCorner {
+	case badgeCornerTopLeft:
+		x, y = bounds.Min.X+margin, bounds.Min.Y+margin+ascent
+	case badgeCornerTopRight:
+		x, y = bounds.Max.X-margin-textWidth, bounds.Min.Y+margin+ascent
+	case badgeCornerBottomLeft:
+		x, y = bounds.Min.X+margin, bounds.Max.Y-margin-descent
+	default: // bottom-right
+		x, y = bounds.Max.X-margin-textWidth, bounds.Max.Y-margin-descent
+	}
+
+	// draw text with a shadow, for being legible on any background
+	alpha := uint8(255 * conf.WatermarkOpacity)
+	fc := freetype.NewContext()
+	fc.SetFont(font)
+	fc.SetDPI(72)
+	fc.SetClip(bounds)
+	fc.SetDst(rgba)
+	fc.SetFontSize(fontSize)
+	for _, layer := range []struct {
+		offset int
+		color  color.NRGBA
+	}{
+		{1, color.NRGBA{0, 0, 0, alpha}},
+		{0, color.NRGBA{255, 255, 255, alpha}},
+	} {
+		fc.SetSrc(&image.Uniform{layer.color})
+		if _, err := fc.DrawString(text, freetype.Pt(x+layer.offset, y+layer.offset)); err != nil {
+			logError(fmt.Sprintf("Failed to draw watermark string: %s", err))
+		}
+	}
+
+	return rgba
+}
+
+// gender of a face with given scores ("male", "female", or "unknown")
+func genderOf(male, female float64) string {
+	if male > female {
+		return "male"
+	} else if female > male {
+		return "female"
+	}
+	return "unknown"
+}
+
+// draw a legend of given labels and their colors at the bottom-left corner of given image
+func drawLegend(img *image.RGBA, labels []string, colors []color.RGBA) {
+	fontSize := float64(img.Bounds().Dy()) / 32.0
+
+	// measure labels
+	face := truetype.NewFace(font, &truetype.Options{Size: fontSize, DPI: 72})
+	defer face.Close()
+	metrics := face.Metrics()
+	ascent, descent := metrics.Ascent.Ceil(), metrics.Descent.Ceil()
+	lineHeight := ascent + descent + BadgePadding
+	textWidth := 0
+	for _, label := range labels {
+		if w := xfont.MeasureString(face, label).Ceil(); w > textWidth {
+			textWidth = w
+		}
+	}
+
+	// fill background
+	bounds := img.Bounds()
+	legendWidth, legendHeight := BadgePadding*3+ascent+textWidth, BadgePadding+lineHeight*len(labels)
+	legend := image.Rect(bounds.Min.X, bounds.Max.Y-legendHeight, bounds.Min.X+legendWidth, bounds.Max.Y)
+	draw.Draw(img, legend, &image.Uniform{color.RGBA{0, 0, 0, 160}}, image.ZP, draw.Over)
+
+	// draw color boxes and labels
+	fc := freetype.NewContext()
+	fc.SetFont(font)
+	fc.SetDPI(72)
+	fc.SetClip(bounds)
+	fc.SetDst(img)
+	fc.SetFontSize(fontSize)
+	fc.SetSrc(&image.Uniform{color.RGBA{255, 255, 255, 255}})
+	for i, label := range labels {
+		x, y := legend.Min.X+BadgePadding, legend.Min.Y+BadgePadding+lineHeight*i
+		draw.Draw(img, image.Rect(x, y, x+ascent, y+ascent), &image.Uniform{colors[i]}, image.ZP, draw.Src)
+
+		if _, err := fc.DrawString(label, freetype.Pt(x+ascent+BadgePadding, y+ascent)); err != nil {
+			logError(fmt.Sprintf("Failed to draw legend string: %s", err))
+		}
+	}
+}
+
+// overlay a grid of normalized coordinates (with axis labels) on given image, for debugging detections
+func drawDebugGrid(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := float64(bounds.Dx()), float64(bounds.Dy())
+
+	newImg := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(newImg, newImg.Bounds(), img, bounds.Min, draw.Src)
+
+	// grid lines (thicker at the center)
+	gc := draw2dimg.NewGraphicContext(newImg)
+	gc.SetFillColor(color.Transparent)
+	gc.SetStrokeColor(color.NRGBA{255, 255, 255, 160})
+	for i := 1; i < DebugGridDivisions; i++ {
+		ratio := float64(i) / DebugGridDivisions
+		if i*2 == DebugGridDivisions {
+			gc.SetLineWidth(StrokeWidth * 2)
+		} else {
+			gc.SetLineWidth(StrokeWidth / 2)
+		}
+
+		gc.MoveTo(width*ratio, 0)
+		gc.LineTo(width*ratio, height)
+		gc.Stroke()
+		gc.MoveTo(0, height*ratio)
+		gc.LineTo(width, height*ratio)
+		gc.Stroke()
+	}
+	gc.Save()
+
+	// axis labels (x along the top edge, y along the left edge)
+	fc := freetype.NewContext()
+	fc.SetFont(font)
+	fc.SetDPI(72)
+	fc.SetClip(newImg.Bounds())
+	fc.SetDst(newImg)
+	fontSize := math.Max(height/40, 10)
+	fc.SetFontSize(fontSize)
+	for i := 1; i < DebugGridDivisions; i++ {
+		ratio := float64(i) / DebugGridDivisions
+		label := fmt.Sprintf("%.1f", ratio)
+		for _, p := range []struct {
+			x, y int
+		}{
+			{int(width*ratio) + 2, int(fontSize) + 2}, // x
+			{2, int(height*ratio) - 2},                // y
+		} {
+			// with shadow, for being legible on any background
+			fc.SetSrc(&image.Uniform{color.RGBA{0, 0, 0, 255}})
+			fc.DrawString(label, freetype.Pt(p.x+1, p.y+1))
+			fc.SetSrc(&image.Uniform{color.RGBA{255, 255, 255, 255}})
+			if _, err := fc.DrawString(label, freetype.Pt(p.x, p.y)); err != nil {
+				logError(fmt.Sprintf("Failed to draw grid label: %s", err))
 			}
-		case Tag:
-			if generated, err := kakaoClient.GenerateTagsFromBytes(imgBytes); err == nil {
-				if len(generated.Result.Labels) > 0 {
-					tags := []string{}
-					for i := 0; i < len(generated.Result.Labels); i++ {
-						tags = append(tags, fmt.Sprintf("%s (%s)", generated.Result.Labels[i], generated.Result.LabelsKorean[i]))
-					}
+		}
+	}
 
-					// send tags
-					message := fmt.Sprintf("Process result of '%s':\n\n%s", command, strings.Join(tags, "\n"))
-					if sent := b.SendMessage(chatID, message, nil); !sent.Ok {
-						errorMessage = fmt.Sprintf("Failed to send tags: %s", *sent.Description)
-					}
-				} else {
-					errorMessage = "Could not tag given image."
+	return newImg
+}
+
+// lines of the panel of report cards
+func reportCardLines(faces kakaoapi.ResponseDetectedFace, products kakaoapi.ResponseDetectedProduct, nsfw kakaoapi.ResponseDetectedNSFW, tags kakaoapi.ResponseGeneratedTags) []string {
+	lines := []string{fmt.Sprintf("Faces: %d", len(faces.Result.Faces))}
+
+	lines = append(lines, fmt.Sprintf("Products: %d", len(products.Result.Objects)))
+	for _, c := range countProductClasses(products) {
+		lines = append(lines, fmt.Sprintf("  %s x%d", c.class, c.count))
+	}
+
+	lines = append(lines,
+		"NSFW:",
+		fmt.Sprintf("  normal %.2f%%", 100.0*nsfw.Result.Normal),
+		fmt.Sprintf("  soft %.2f%%", 100.0*nsfw.Result.Soft),
+		fmt.Sprintf("  adult %.2f%%", 100.0*nsfw.Result.Adult),
+	)
+
+	lines = append(lines, "Tags:")
+	for i, label := range tags.Result.Labels {
+		if i >= ReportCardMaxTags {
+			break
+		}
+		lines = append(lines, "  "+label) // (korean labels are not drawable with the bundled font)
+	}
+	if len(tags.Result.Labels) <= 0 {
+		lines = append(lines, "  (none)")
+	}
+
+	return lines
+}
+
+// render a report card: thumbnail of given image on the left, and given lines on the right
+func renderReportCard(img image.Image, lines []string) *image.RGBA {
+	// thumbnail
+	g := gift.New(gift.ResizeToFit(ReportCardThumbnailSize, ReportCardThumbnailSize, gift.LinearResampling))
+	thumbnail := image.NewRGBA(g.Bounds(img.Bounds()))
+	g.Draw(thumbnail, img)
+
+	// measure lines
+	face := truetype.NewFace(font, &truetype.Options{Size: ReportCardFontSize, DPI: 72})
+	defer face.Close()
+	metrics := face.Metrics()
+	ascent, lineHeight := metrics.Ascent.Ceil(), metrics.Height.Ceil()
+	panelHeight := ReportCardPadding*2 + lineHeight*len(lines)
+
+	// canvas
+	thumbBounds := thumbnail.Bounds()
+	width := thumbBounds.Dx() + ReportCardPanelWidth
+	height := int(math.Max(float64(thumbBounds.Dy()), float64(panelHeight)))
+	card := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(card, card.Bounds(), &image.Uniform{color.RGBA{255, 255, 255, 255}}, image.ZP, draw.Src)
+	draw.Draw(card, thumbBounds.Add(image.Pt(0, (height-thumbBounds.Dy())/2)), thumbnail, thumbBounds.Min, draw.Src)
+
+	// panel
+	fc := freetype.NewContext()
+	fc.SetFont(font)
+	fc.SetDPI(72)
+	fc.SetClip(card.Bounds())
+	fc.SetDst(card)
+	fc.SetFontSize(ReportCardFontSize)
+	fc.SetSrc(&image.Uniform{color.RGBA{0, 0, 0, 255}})
+	x := thumbBounds.Dx() + ReportCardPadding
+	for i, line := range lines {
+		if _, err := fc.DrawString(line, freetype.Pt(x, ReportCardPadding+lineHeight*i+ascent)); err != nil {
+			logError(fmt.Sprintf("Failed to draw report card string: %s", err))
+		}
+	}
+
+	return card
+}
+
+// render a contact sheet which tiles given (cropped) images with their labels underneath
+func renderFaceSheet(crops []image.Image, labels []string) *image.RGBA {
+	columns := int(math.Ceil(math.Sqrt(float64(len(crops)))))
+	if columns > FaceSheetMaxColumns {
+		columns = FaceSheetMaxColumns
+	}
+	rows := (len(crops) + columns - 1) / columns
+
+	// canvas
+	tileWidth, tileHeight := FaceSheetTileSize+FaceSheetPadding*2, FaceSheetTileSize+FaceSheetLabelHeight+FaceSheetPadding*2
+	sheet := image.NewRGBA(image.Rect(0, 0, tileWidth*columns, tileHeight*rows))
+	draw.Draw(sheet, sheet.Bounds(), &image.Uniform{color.RGBA{255, 255, 255, 255}}, image.ZP, draw.Src)
+
+	// labels
+	fc := freetype.NewContext()
+	fc.SetFont(font)
+	fc.SetDPI(72)
+	fc.SetClip(sheet.Bounds())
+	fc.SetDst(sheet)
+	fc.SetFontSize(FaceSheetFontSize)
+	fc.SetSrc(&image.Uniform{color.RGBA{0, 0, 0, 255}})
+
+	face := truetype.NewFace(font, &truetype.Options{Size: FaceSheetFontSize, DPI: 72})
+	defer face.Close()
+	ascent := face.Metrics().Ascent.Ceil()
+
+	for i, crop := range crops {
+		x, y := (i%columns)*tileWidth+FaceSheetPadding, (i/columns)*tileHeight+FaceSheetPadding
+
+		// fit the crop in its tile, centered
+		g := gift.New(gift.ResizeToFit(FaceSheetTileSize, FaceSheetTileSize, gift.LinearResampling))
+		thumbnail := image.NewRGBA(g.Bounds(crop.Bounds()))
+		g.Draw(thumbnail, crop)
+		offset := image.Pt(x+(FaceSheetTileSize-thumbnail.Bounds().Dx())/2, y+(FaceSheetTileSize-thumbnail.Bounds().Dy())/2)
+		draw.Draw(sheet, thumbnail.Bounds().Add(offset), thumbnail, image.ZP, draw.Src)
+
+		// label underneath, centered
+		labelWidth := xfont.MeasureString(face, labels[i]).Ceil()
+		labelY := y + FaceSheetTileSize + (FaceSheetLabelHeight-face.Metrics().Height.Ceil())/2 + ascent
+		if _, err := fc.DrawString(labels[i], freetype.Pt(x+(FaceSheetTileSize-labelWidth)/2, labelY)); err != nil {
+			logError(fmt.Sprintf("Failed to draw face sheet string: %s", err))
+		}
+	}
+
+	return sheet
+}
+
+// tile of an image scored by the nsfw detection api
+type nsfwTile struct {
+	rect  image.Rectangle
+	score float64 // how much it is not normal (soft + adult)
+}
+
+// split given image into tiles of about `nsfw-tile-size`, and score each of them with concurrent api calls
+//
+// (the nsfw detection api returns only a decision of the whole image, so regions are localized with tiles)
+func scoreNSFWTiles(client timedKakaoClient, img image.Image) ([]nsfwTile, error) {
+	bounds := img.Bounds()
+
+	// enlarge tiles when there would be too many of them
+	tileSize := conf.NSFWTileSize
+	for int(math.Ceil(float64(bounds.Dx())/float64(tileSize))*math.Ceil(float64(bounds.Dy())/float64(tileSize))) > MaxNSFWTiles {
+		tileSize = tileSize * 5 / 4
+	}
+
+	// (evenly divided, for not leaving thin slivers at the edges)
+	columns, rows := int(math.Ceil(float64(bounds.Dx())/float64(tileSize))), int(math.Ceil(float64(bounds.Dy())/float64(tileSize)))
+	tiles := []nsfwTile{}
+	for row := 0; row < rows; row++ {
+		for column := 0; column < columns; column++ {
+			tiles = append(tiles, nsfwTile{rect: image.Rect(
+				bounds.Min.X+bounds.Dx()*column/columns,
+				bounds.Min.Y+bounds.Dy()*row/rows,
+				bounds.Min.X+bounds.Dx()*(column+1)/columns,
+				bounds.Min.Y+bounds.Dy()*(row+1)/rows,
+			)})
+		}
+	}
+
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	var firstErr error
+	semaphore := make(chan struct{}, conf.NSFWTileConcurrency)
+	for i := range tiles {
+		wg.Add(1)
+		semaphore <- struct{}{}
+
+		go func(tile *nsfwTile) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			buf := new(bytes.Buffer)
+			err := jpeg.Encode(buf, cropImage(img, tile.rect, 0), nil)
+			if err == nil {
+				var detected kakaoapi.ResponseDetectedNSFW
+				if detected, err = client.DetectNSFWFromBytes(buf.Bytes()); err == nil {
+					tile.score = detected.Result.Soft + detected.Result.Adult
 				}
-			} else {
-				errorMessage = fmt.Sprintf("Failed to tag image: %s", err)
 			}
-		case AnalyzePoses:
-			var analyzed kakaoapi.ResponseAnalyzedPose
-			analyzed, err = kakaoClient.AnalyzePoseFromBytes(imgBytes)
-			if err == nil {
-				var img image.Image
-				imgReader := bytes.NewReader(imgBytes)
-				img, _, err = image.Decode(imgReader)
-				if err == nil {
-					newImg := processImageForPoses(img, analyzed)
+			if err != nil {
+				errLock.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to score tile %v: %s", tile.rect, err)
+				}
+				errLock.Unlock()
+			}
+		}(&tiles[i])
+	}
+	wg.Wait()
 
-					// 'uploading photo...'
-					b.SendChatAction(chatID, bot.ChatActionUploadPhoto)
+	return tiles, firstErr
+}
 
-					// send a photo with lines drawn on poses
-					buf := new(bytes.Buffer)
-					err = jpeg.Encode(buf, newImg, nil)
-					if err == nil {
-						if sent := b.SendPhoto(
-							chatID,
-							bot.InputFileFromBytes(buf.Bytes()),
-							bot.OptionsSendPhoto{}.SetCaption(fmt.Sprintf("Process result of '%s'", command)),
-						); !sent.Ok {
-							errorMessage = fmt.Sprintf("Failed to send image: %s", *sent.Description)
-						}
-					} else {
-						errorMessage = fmt.Sprintf("Failed to encode image: %s", err)
-					}
-				} else {
-					errorMessage = fmt.Sprintf("Failed to decode image: %s", err)
+// overlay scores of given nsfw tiles on an image, colored from blue (normal) to red (flagged)
+func drawNSFWHeatmap(img image.Image, tiles []nsfwTile) *image.RGBA {
+	bounds := img.Bounds()
+
+	newImg := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(newImg, newImg.Bounds(), img, bounds.Min, draw.Src)
+
+	fc := freetype.NewContext()
+	fc.SetFont(font)
+	fc.SetDPI(72)
+	fc.SetClip(newImg.Bounds())
+	fc.SetDst(newImg)
+
+	for _, tile := range tiles {
+		rect := tile.rect.Sub(bounds.Min)
+		draw.Draw(newImg, rect, &image.Uniform{heatColor(tile.score)}, image.ZP, draw.Over)
+
+		// score of the tile, on its top-left corner
+		label := fmt.Sprintf("%.0f%%", tile.score*100)
+		fontSize := math.Max(float64(rect.Dy())/8, 10)
+		fc.SetFontSize(fontSize)
+		x, y := rect.Min.X+4, rect.Min.Y+int(fontSize)+2
+
+		// with shadow, for being legible on any background
+		fc.SetSrc(&image.Uniform{color.RGBA{0, 0, 0, 255}})
+		fc.DrawString(label, freetype.Pt(x+1, y+1))
+		fc.SetSrc(&image.Uniform{color.RGBA{255, 255, 255, 255}})
+		if _, err := fc.DrawString(label, freetype.Pt(x, y)); err != nil {
+			logError(fmt.Sprintf("Failed to draw nsfw heatmap string: %s", err))
+		}
+	}
+
+	// tile borders
+	gc := draw2dimg.NewGraphicContext(newImg)
+	gc.SetFillColor(color.Transparent)
+	gc.SetStrokeColor(color.NRGBA{255, 255, 255, 160})
+	gc.SetLineWidth(StrokeWidth / 2)
+	for _, tile := range tiles {
+		rect := tile.rect.Sub(bounds.Min)
+		gc.MoveTo(float64(rect.Min.X), float64(rect.Min.Y))
+		gc.LineTo(float64(rect.Max.X), float64(rect.Min.Y))
+		gc.LineTo(float64(rect.Max.X), float64(rect.Max.Y))
+		gc.LineTo(float64(rect.Min.X), float64(rect.Max.Y))
+		gc.Close()
+		gc.Stroke()
+	}
+	gc.Save()
+
+	return newImg
+}
+
+// blend a heatmap of given (normalized) centers of detections on given image
+//
+// (dots are accumulated in a small buffer, blurred, then colored from blue (sparse) to red (dense))
+func densityHeatmap(img image.Image, centers [][2]float64) *image.RGBA {
+	bounds := img.Bounds()
+
+	// accumulate dots
+	scale := float64(HeatmapScaleSize) / math.Max(float64(bounds.Dx()), float64(bounds.Dy()))
+	w, h := int(math.Max(1, float64(bounds.Dx())*scale)), int(math.Max(1, float64(bounds.Dy())*scale))
+	acc := image.NewGray16(image.Rect(0, 0, w, h))
+	for _, c := range centers {
+		cx, cy := int(c[0]*float64(w)), int(c[1]*float64(h))
+		for y := cy - HeatmapDotRadius; y <= cy+HeatmapDotRadius; y++ {
+			for x := cx - HeatmapDotRadius; x <= cx+HeatmapDotRadius; x++ {
+				if (x-cx)*(x-cx)+(y-cy)*(y-cy) > HeatmapDotRadius*HeatmapDotRadius || !(image.Point{x, y}).In(acc.Bounds()) {
+					continue
 				}
-			} else {
-				errorMessage = fmt.Sprintf("Failed to detect faces: %s", err)
-			}
-		case ExtractTexts:
-			var detected kakaoapi.ResponseDetectedText
-			detected, err = kakaoClient.DetectTextFromBytes(imgBytes)
-			if err == nil {
-				strs := []string{}
-				for _, result := range detected.Result {
-					strs = append(strs, result.RecognizedWords...)
+
+				value := int(acc.Gray16At(x, y).Y) + HeatmapIncrement
+				if value > math.MaxUint16 {
+					value = math.MaxUint16
 				}
+				acc.SetGray16(x, y, color.Gray16{uint16(value)})
+			}
+		}
+	}
 
-				message := fmt.Sprintf(`Process result of '%s':
+	// blur them
+	blurred := image.NewGray16(acc.Bounds())
+	gift.New(gift.GaussianBlur(float32(HeatmapScaleSize*HeatmapSigmaRatio))).Draw(blurred, acc)
 
-%s`,
-					command,
-					strings.Join(strs, ", "),
-				)
-				if sent := b.SendMessage(chatID, message, nil); !sent.Ok {
-					errorMessage = fmt.Sprintf("Failed to send extracted texts: %s", *sent.Description)
+	maxValue := 0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if v := int(blurred.Gray16At(x, y).Y); v > maxValue {
+				maxValue = v
+			}
+		}
+	}
+
+	// color them
+	overlay := image.NewNRGBA(blurred.Bounds())
+	if maxValue > 0 {
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				density := float64(blurred.Gray16At(x, y).Y) / float64(maxValue)
+				if density < HeatmapMinDensity {
+					continue
 				}
-			} else {
-				errorMessage = fmt.Sprintf("Failed to detect texts: %s", err)
+				overlay.SetNRGBA(x, y, heatColor(density))
 			}
-		default:
-			errorMessage = fmt.Sprintf("Command not supported: %s", command)
 		}
-	} else {
-		errorMessage = fmt.Sprintf("Failed to read file from %s: %s", fileURL, err)
 	}
 
-	// delete original message
-	b.DeleteMessage(chatID, messageIDToDelete)
+	// scale it up, and blend it on the image
+	g := gift.New(gift.Resize(bounds.Dx(), bounds.Dy(), gift.LinearResampling))
+	scaled := image.NewNRGBA(g.Bounds(overlay.Bounds()))
+	g.Draw(scaled, overlay)
 
-	// if there was any error, send it back
-	if errorMessage != "" {
-		b.SendMessage(chatID, errorMessage, nil)
+	newImg := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(newImg, newImg.Bounds(), img, bounds.Min, draw.Src)
+	draw.Draw(newImg, newImg.Bounds(), scaled, image.ZP, draw.Over)
+
+	return newImg
+}
 
-		logError(errorMessage)
+// color for given (normalized) density: blue -> cyan -> green -> yellow -> red
+func heatColor(density float64) color.NRGBA {
+	var r, g, b float64
+	switch {
+	case density < 0.25:
+		g, b = density/0.25, 1
+	case density < 0.5:
+		g, b = 1, 1-(density-0.25)/0.25
+	case density < 0.75:
+		r, g = (density-0.5)/0.25, 1
+	default:
+		r, g = 1, 1-(density-0.75)/0.25
 	}
+
+	return color.NRGBA{uint8(r * 255), uint8(g * 255), uint8(b * 255), uint8(density * HeatmapMaxAlpha * 255)}
 }
 
-// generate inline keyboards for selecting action
-func genImageInlineKeyboards(fileID string) [][]bot.InlineKeyboardButton {
-	shortenedFileID := fileID[:32]
-	fileIDs[shortenedFileID] = fileID
+// black or white, whichever is more legible on given color
+func contrastingColor(c color.RGBA) color.RGBA {
+	luminance := 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+	if luminance > 128 {
+		return color.RGBA{0, 0, 0, 255}
+	}
+	return color.RGBA{255, 255, 255, 255}
+}
 
-	data := map[string]string{}
-	for title, cmd := range allCmds {
-		data[string(title)] = fmt.Sprintf("%s/%s", cmd, shortenedFileID)
+// dominant color and its ratio in an image
+type dominantColor struct {
+	color color.RGBA
+	ratio float64
+}
+
+// top n dominant colors of given image, with histogram quantization (4 bits per channel)
+func dominantColors(img image.Image, n int) []dominantColor {
+	// scale down for speed
+	g := gift.New(gift.ResizeToFit(DominantColorsScaleSize, DominantColorsScaleSize, gift.LinearResampling))
+	scaled := image.NewRGBA(g.Bounds(img.Bounds()))
+	g.Draw(scaled, img)
+
+	// accumulate pixels into quantized bins
+	type bin struct {
+		count   int
+		r, g, b int
+		key     int
+	}
+	bins := map[int]*bin{}
+	total := 0
+	for i := 0; i+3 < len(scaled.Pix); i += 4 {
+		red, green, blue, alpha := int(scaled.Pix[i]), int(scaled.Pix[i+1]), int(scaled.Pix[i+2]), scaled.Pix[i+3]
+		if alpha == 0 {
+			continue // skip transparent ones
+		}
+
+		key := (red>>4)<<8 | (green>>4)<<4 | (blue >> 4)
+		if _, exists := bins[key]; !exists {
+			bins[key] = &bin{key: key}
+		}
+		bins[key].count++
+		bins[key].r += red
+		bins[key].g += green
+		bins[key].b += blue
+		total++
 	}
 
-	cancel := commandCancel
-	return append(bot.NewInlineKeyboardButtonsAsRowsWithCallbackData(data), []bot.InlineKeyboardButton{
-		{Text: strings.Title(commandCancel), CallbackData: &cancel},
+	// most frequent ones first
+	sorted := []*bin{}
+	for _, quantized := range bins {
+		sorted = append(sorted, quantized)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count == sorted[j].count {
+			return sorted[i].key < sorted[j].key
+		}
+		return sorted[i].count > sorted[j].count
 	})
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+
+	// average colors of bins
+	colors := []dominantColor{}
+	for _, quantized := range sorted {
+		colors = append(colors, dominantColor{
+			color: color.RGBA{uint8(quantized.r / quantized.count), uint8(quantized.g / quantized.count), uint8(quantized.b / quantized.count), 255},
+			ratio: float64(quantized.count) / float64(total),
+		})
+	}
+
+	return colors
+}
+
+// image of color swatches (side by side)
+func colorSwatches(colors []dominantColor) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, ColorSwatchSize*int(math.Max(float64(len(colors)), 1)), ColorSwatchSize))
+	for i, c := range colors {
+		draw.Draw(img, image.Rect(i*ColorSwatchSize, 0, (i+1)*ColorSwatchSize, ColorSwatchSize), &image.Uniform{c.color}, image.ZP, draw.Src)
+	}
+
+	return img
+}
+
+// colors for annotating images of given chat (default ones if not set, or invalid)
+func paletteFor(chatID int64) []color.RGBA {
+	palette := []color.RGBA{}
+	for _, hex := range chatSettingsFor(chatID).Colors {
+		c, err := parseHexColor(hex)
+		if err != nil {
+			logError(fmt.Sprintf("Invalid color in settings of chat %d: %s", chatID, err))
+
+			return colors
+		}
+		palette = append(palette, c)
+	}
+	if len(palette) <= 0 {
+		return colors
+	}
+
+	return palette
 }
 
+// color of a label text drawn with a box of given color
+func labelColor(boxColor color.RGBA) color.Color {
+	if labelTextColor != nil {
+		return labelTextColor
+	}
+
+	return boxColor
+}
+
+// hex color (eg. `#FF0000` or `ff0000`) to color
+func parseHexColor(hex string) (color.RGBA, error) {
+	if !hexColorRegexp.MatchString(hex) {
+		return color.RGBA{}, fmt.Errorf("not a hex color: %s", hex)
+	}
+
+	value, err := strconv.ParseUint(strings.TrimPrefix(hex, "#"), 16, 32)
+	if err != nil {
+		return color.RGBA{}, err
+	}
+
+	return color.RGBA{uint8(value >> 16), uint8(value >> 8), uint8(value), 255}, nil
+}
+
+// color to hex color (eg. `#ff0000`)
+func hexOfColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+var hexColorRegexp = regexp.MustCompile(`^#?[0-9a-fA-F]{6}$`)
+
 // rotate color
-func colorForIndex(i int) color.RGBA {
-	length := len(colors)
-	return colors[i%length]
+func colorForIndex(palette []color.RGBA, i int) color.RGBA {
+	if len(palette) <= 0 {
+		palette = colors
+	}
+
+	length := len(palette)
+	return palette[i%length]
 }
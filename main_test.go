@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/freetype/truetype"
+	kakaoapi "github.com/meinside/kakao-api-go"
+)
+
+// load font and emoji for drawing on images (done in `initialize` when running)
+func loadDrawingResources(t *testing.T) {
+	t.Helper()
+
+	fontBytes, err := ioutil.ReadFile(fontFilepath)
+	if err != nil {
+		t.Fatalf("failed to read font: %s", err)
+	}
+	if font, err = truetype.Parse(fontBytes); err != nil {
+		t.Fatalf("failed to parse font: %s", err)
+	}
+	if emoji, _, err = image.Decode(bytes.NewReader(defaultEmojiBytes)); err != nil {
+		t.Fatalf("failed to decode emoji: %s", err)
+	}
+}
+
+// blank white image of given size
+func blankImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.White}, image.ZP, draw.Src)
+
+	return img
+}
+
+// whether given images have the same pixels
+func samePixels(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// getenv function which returns values from given map
+func fakeGetenv(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func TestMergeEnvVars(t *testing.T) {
+	env := map[string]string{
+		envTelegramAPIToken: "env-telegram-token",
+		envKakaoAPIKey:      "env-kakao-key",
+		envLogglyToken:      "env-loggly-token",
+	}
+
+	tests := []struct {
+		name     string
+		conf     Config
+		env      map[string]string
+		expected Config
+		keys     []string
+	}{
+		{
+			name: "values in the config file are kept over environment variables",
+			conf: Config{
+				TelegramAPIToken: "file-telegram-token",
+				KakaoAPIKey:      "file-kakao-key",
+				LogglyToken:      "file-loggly-token",
+			},
+			env: env,
+			expected: Config{
+				TelegramAPIToken: "file-telegram-token",
+				KakaoAPIKey:      "file-kakao-key",
+				LogglyToken:      "file-loggly-token",
+			},
+			keys: []string{"file-kakao-key"},
+		},
+		{
+			name: "environment variables are used when values in the config file are empty",
+			conf: Config{},
+			env:  env,
+			expected: Config{
+				TelegramAPIToken: "env-telegram-token",
+				KakaoAPIKey:      "env-kakao-key",
+				LogglyToken:      "env-loggly-token",
+			},
+			keys: []string{"env-kakao-key"},
+		},
+		{
+			name: "loggly token stays empty without the variable, and multiple kakao keys are merged without duplicates",
+			conf: Config{
+				TelegramAPIToken: "file-telegram-token",
+				KakaoAPIKeys:     []string{"file-kakao-key-1", "env-kakao-key", "file-kakao-key-2"},
+			},
+			env: map[string]string{
+				envKakaoAPIKey: "env-kakao-key",
+			},
+			expected: Config{
+				TelegramAPIToken: "file-telegram-token",
+				KakaoAPIKey:      "env-kakao-key",
+				KakaoAPIKeys:     []string{"file-kakao-key-1", "env-kakao-key", "file-kakao-key-2"},
+			},
+			keys: []string{"env-kakao-key", "file-kakao-key-1", "file-kakao-key-2"},
+		},
+	}
+
+	for _, test := range tests {
+		merged := mergeEnvVars(test.conf, fakeGetenv(test.env))
+		if !reflect.DeepEqual(merged, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, merged)
+		}
+		if keys := kakaoAPIKeys(merged); !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("%s: expected kakao api keys %v, got %v", test.name, test.keys, keys)
+		}
+	}
+}
+
+// empty boxes: zero width, zero height, negative width, and negative height (as normalized x, y, w, h)
+var emptyBoxes = [][4]float64{
+	{0.5, 0.5, 0, 0.2},
+	{0.5, 0.5, 0.2, 0},
+	{0.5, 0.5, -0.2, 0.2},
+	{0.5, 0.5, 0.2, -0.2},
+}
+
+func TestRegionRect(t *testing.T) {
+	bounds := image.Rect(0, 0, 100, 100)
+
+	for _, box := range emptyBoxes {
+		x, y, w, h := box[0], box[1], box[2], box[3]
+		if rect, ok := regionRect(x, y, x+w, y+h, 100, 100, bounds); ok {
+			t.Errorf("empty box %v should be skipped, got %v", box, rect)
+		}
+	}
+
+	// clamped to the bounds
+	if rect, ok := regionRect(0.5, 0.5, 1.5, 1.5, 100, 100, bounds); !ok || rect != image.Rect(50, 50, 100, 100) {
+		t.Errorf("box should be clamped to the bounds, got %v (%t)", rect, ok)
+	}
+
+	// out of the bounds
+	if rect, ok := regionRect(1.5, 1.5, 2.0, 2.0, 100, 100, bounds); ok {
+		t.Errorf("box out of the bounds should be skipped, got %v", rect)
+	}
+}
+
+func TestProcessImageForFacesWithEmptyBoxes(t *testing.T) {
+	loadDrawingResources(t)
+
+	for _, box := range emptyBoxes {
+		var detected kakaoapi.ResponseDetectedFace
+		if err := json.Unmarshal([]byte(fmt.Sprintf(
+			`{"result": {"width": 100, "height": 100, "faces": [{"x": %f, "y": %f, "w": %f, "h": %f}]}}`,
+			box[0], box[1], box[2], box[3],
+		)), &detected); err != nil {
+			t.Fatalf("failed to build detected faces: %s", err)
+		}
+
+		for _, command := range []VisionCommand{DetectFaces, EmojiFaces, MaskFaces} {
+			for _, maskStyle := range []string{maskStylePixelate, maskStyleBlur, maskStyleBlackbox} {
+				img := blankImage(100, 100)
+
+				if processed := processImageForFaces(img, detected, command, maskStyle, colors); !samePixels(img, processed) {
+					t.Errorf("empty box %v should not be drawn with '%s' (%s)", box, command, maskStyle)
+				}
+			}
+		}
+	}
+}
+
+func TestProcessImageForProductsWithEmptyBoxes(t *testing.T) {
+	loadDrawingResources(t)
+
+	for _, box := range emptyBoxes {
+		var detected kakaoapi.ResponseDetectedProduct
+		if err := json.Unmarshal([]byte(fmt.Sprintf(
+			`{"result": {"width": 100, "height": 100, "objects": [{"x1": %f, "y1": %f, "x2": %f, "y2": %f, "class": "bag"}]}}`,
+			box[0], box[1], box[0]+box[2], box[1]+box[3],
+		)), &detected); err != nil {
+			t.Fatalf("failed to build detected products: %s", err)
+		}
+
+		img := blankImage(100, 100)
+
+		processed, classes := processImageForProducts(img, detected, colors)
+		if !samePixels(img, processed) {
+			t.Errorf("empty box %v should not be drawn", box)
+		}
+		if len(classes) != 1 {
+			t.Errorf("empty box %v should still be listed, got %v", box, classes)
+		}
+	}
+}
+
+func TestDrawPosesStrokeWidth(t *testing.T) {
+	defer func(c Config) { conf = c }(conf)
+
+	// a single vertical limb from the left elbow to the left wrist (other keypoints are on the elbow)
+	pose := kakaoapi.AnalyzedPose{KeyPoints: []float64{}}
+	for i := 0; i < 17; i++ {
+		if kakaoapi.KeyPointIndex(i) == kakaoapi.KeyPointIndexLeftWrist {
+			pose.KeyPoints = append(pose.KeyPoints, 50, 90, 1)
+		} else {
+			pose.KeyPoints = append(pose.KeyPoints, 50, 10, 1)
+		}
+	}
+	black := []color.RGBA{{0, 0, 0, 255}}
+
+	for _, strokeWidth := range []float64{PoseStrokeWidth, 4, 8} {
+		conf = Config{
+			PoseStrokeWidth:  strokeWidth,
+			PoseColoring:     poseColoringPerson,
+			PoseTorsoStyle:   poseTorsoCross,
+			PoseSkeletonOnly: true,
+		}
+
+		img := blankImage(100, 100)
+		drawPoses(img, kakaoapi.ResponseAnalyzedPose{pose}, black)
+
+		// sum of the stroke's coverage across a row in the middle of the limb
+		coverage := 0.0
+		for x := 0; x < 100; x++ {
+			coverage += float64(255-img.RGBAAt(x, 50).R) / 255
+		}
+		if math.Abs(coverage-strokeWidth) > 0.5 {
+			t.Errorf("expected stroke width %.1f, got %.2f", strokeWidth, coverage)
+		}
+	}
+}
+
+func TestWithKakaoTimeoutBoundsPendingCalls(t *testing.T) {
+	defer func(c Config) { conf = c }(conf)
+	conf = Config{KakaoTimeoutSeconds: 1}
+
+	// fill all slots with calls which time out, but keep running
+	release := make(chan struct{})
+	for i := 0; i < MaxPendingKakaoCalls; i++ {
+		go withKakaoTimeout(func() error {
+			<-release
+			return nil
+		})
+	}
+
+	// wait for them to take the slots
+	for len(kakaoCallSlots) < MaxPendingKakaoCalls {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	called := false
+	if err := withKakaoTimeout(func() error {
+		called = true
+		return nil
+	}); err == nil || called {
+		t.Errorf("call should not run while all slots are taken (error: %v)", err)
+	}
+
+	// slots are freed when the pending calls finish
+	close(release)
+	for len(kakaoCallSlots) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := withKakaoTimeout(func() error { return nil }); err != nil {
+		t.Errorf("call should run after slots are freed: %s", err)
+	}
+}
+
+func TestBotAPIFilePath(t *testing.T) {
+	defer func(c Config) { conf = c }(conf)
+
+	root, err := ioutil.TempDir("", "bot-api-files-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "files")
+	inside := filepath.Join(dir, "photos", "file_0.jpg")
+	outside := filepath.Join(root, "secret.txt")
+	link := filepath.Join(dir, "link.txt")
+	for _, path := range []string{inside, outside} {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("failed to create dir: %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte("test"), 0600); err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+	}
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
+
+	// not set
+	conf = Config{}
+	if _, err := botAPIFilePath(inside); err == nil {
+		t.Errorf("files should not be read without bot-api-files-dir")
+	}
+
+	conf = Config{BotAPIFilesDir: dir, MaxDownloadBytes: defaultMaxDownloadBytes}
+	if _, err := botAPIFilePath(inside); err != nil {
+		t.Errorf("file in bot-api-files-dir should be allowed: %s", err)
+	}
+	for _, path := range []string{
+		outside,
+		filepath.Join(dir, "..", "secret.txt"),
+		link,
+		dir,
+	} {
+		if _, err := botAPIFilePath(path); err == nil {
+			t.Errorf("file out of bot-api-files-dir should not be allowed: %s", path)
+		}
+		if _, err := readBytes(localFileURLPrefix + path); err == nil {
+			t.Errorf("file out of bot-api-files-dir should not be read: %s", path)
+		}
+	}
+
+	// plain absolute paths are not read as local files
+	if _, err := readBytes(outside); err == nil {
+		t.Errorf("plain absolute path should not be read: %s", outside)
+	}
+	if bytes, err := readBytes(localFileURLPrefix + inside); err != nil || string(bytes) != "test" {
+		t.Errorf("file in bot-api-files-dir should be read: %s", err)
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+// minimal pdf reader for extracting the image embedded on the first page of scanned documents
+//
+// (pdf is not rasterized, as no pure-go rasterizer is available for CGO_ENABLED=0 builds:
+// text and vector contents are not rendered, and only embedded images are used)
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// limits for untrusted pdf documents
+const (
+	MaxPDFStreamBytes = 64 * 1024 * 1024 // max size of a decompressed pdf stream
+	MaxPDFImagePixels = 40 * 1000 * 1000 // max number of pixels of an image in pdf
+)
+
+// error for a pdf document whose first page has no embedded image which can be processed
+var errNoImageInPDF = fmt.Errorf("no supported image embedded on the first page of pdf")
+
+// minimal pdf object model, for finding images of the first page
+//
+// (values are int64, float64, bool, nil, string, pdfName, pdfRef, pdfArray, pdfDict, or pdfStream)
+type pdfName string
+type pdfRef struct {
+	id, gen int
+}
+type pdfArray []interface{}
+type pdfDict map[pdfName]interface{}
+type pdfStream struct {
+	dict pdfDict
+	data []byte // still encoded with its filters
+}
+
+// parser of pdf objects
+type pdfParser struct {
+	data []byte
+	pos  int
+}
+
+const pdfMaxNesting = 32 // max depth of nested arrays/dicts (and chained references)
+
+// pdf delimiters and whitespaces which end names, numbers, and keywords
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/% \t\r\n\f\x00", c) >= 0
+}
+
+// skip whitespaces and comments
+func (p *pdfParser) skipSpaces() {
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case c == '%':
+			for p.pos < len(p.data) && p.data[p.pos] != '\r' && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		case strings.IndexByte(" \t\r\n\f\x00", c) >= 0:
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+// read a regular token (name, number, or keyword) at the current position
+func (p *pdfParser) readToken() string {
+	start := p.pos
+	for p.pos < len(p.data) && !isPDFDelimiter(p.data[p.pos]) {
+		p.pos++
+	}
+
+	return string(p.data[start:p.pos])
+}
+
+// parse an object at the current position
+func (p *pdfParser) parseObject(depth int) (interface{}, error) {
+	if depth > pdfMaxNesting {
+		return nil, fmt.Errorf("too deeply nested objects")
+	}
+
+	p.skipSpaces()
+	if p.pos >= len(p.data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	switch c := p.data[p.pos]; {
+	case bytes.HasPrefix(p.data[p.pos:], []byte("<<")):
+		p.pos += 2
+		dict := pdfDict{}
+		for {
+			p.skipSpaces()
+			if bytes.HasPrefix(p.data[p.pos:], []byte(">>")) {
+				p.pos += 2
+				return dict, nil
+			}
+			key, err := p.parseObject(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(pdfName)
+			if !ok {
+				return nil, fmt.Errorf("non-name key in dictionary at %d", p.pos)
+			}
+			if dict[name], err = p.parseObject(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+	case c == '[':
+		p.pos++
+		array := pdfArray{}
+		for {
+			p.skipSpaces()
+			if p.pos < len(p.data) && p.data[p.pos] == ']' {
+				p.pos++
+				return array, nil
+			}
+			value, err := p.parseObject(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+	case c == '<':
+		end := bytes.IndexByte(p.data[p.pos:], '>')
+		if end < 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		hex := string(p.data[p.pos+1 : p.pos+end])
+		p.pos += end + 1
+		return hex, nil
+	case c == '(':
+		// (nested parentheses are balanced unless escaped)
+		start, nesting := p.pos+1, 0
+		for p.pos++; p.pos < len(p.data); p.pos++ {
+			switch p.data[p.pos] {
+			case '\\':
+				p.pos++
+			case '(':
+				nesting++
+			case ')':
+				if nesting == 0 {
+					p.pos++
+					return string(p.data[start : p.pos-1]), nil
+				}
+				nesting--
+			}
+		}
+		return nil, io.ErrUnexpectedEOF
+	case c == '/':
+		p.pos++
+		return pdfName(p.readToken()), nil
+	case strings.IndexByte("+-.0123456789", c) >= 0:
+		token := p.readToken()
+		if strings.ContainsAny(token, ".") {
+			return strconv.ParseFloat(token, 64)
+		}
+		number, err := strconv.ParseInt(token, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		// `ID GENERATION R` is a reference
+		if saved := p.pos; number >= 0 {
+			p.skipSpaces()
+			if gen, err := strconv.Atoi(p.readToken()); err == nil {
+				p.skipSpaces()
+				if p.pos < len(p.data) && p.data[p.pos] == 'R' && (p.pos+1 >= len(p.data) || isPDFDelimiter(p.data[p.pos+1])) {
+					p.pos++
+					return pdfRef{int(number), gen}, nil
+				}
+			}
+			p.pos = saved
+		}
+		return number, nil
+	default:
+		switch token := p.readToken(); token {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("unexpected token '%s' at %d", token, p.pos)
+		}
+	}
+}
+
+// pdf document with its objects indexed by id
+type pdfDocument struct {
+	data    []byte
+	offsets map[int]int // id -> offset of an indirect object's body
+	objects map[int]interface{}
+}
+
+// for finding indirect objects (`ID GENERATION obj`) and the document catalog
+var pdfObjectRegexp = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+var pdfRootRegexp = regexp.MustCompile(`/Root\s+(\d+)\s+(\d+)\s+R`)
+
+// index indirect objects of given pdf bytes, including ones in object streams
+//
+// (objects are scanned in order, and stream data are skipped for not matching their contents;
+// later definitions of the same id win, as with incremental updates)
+func newPDFDocument(data []byte) *pdfDocument {
+	doc := &pdfDocument{data: data, offsets: map[int]int{}, objects: map[int]interface{}{}}
+
+	objectStreams := []int{}
+	for pos := 0; pos < len(data); {
+		loc := pdfObjectRegexp.FindSubmatchIndex(data[pos:])
+		if loc == nil {
+			break
+		}
+		id, _ := strconv.Atoi(string(data[pos+loc[2] : pos+loc[3]]))
+		offset := pos + loc[1]
+		pos = offset
+
+		doc.offsets[id] = offset
+		delete(doc.objects, id)
+
+		if obj, end, err := doc.parseIndirectObject(offset); err == nil {
+			pos = end
+			if stream, ok := obj.(pdfStream); ok && stream.dict["Type"] == pdfName("ObjStm") {
+				objectStreams = append(objectStreams, id)
+			}
+		}
+	}
+
+	// objects in object streams (only when not defined as indirect objects)
+	for _, id := range objectStreams {
+		stream, ok := doc.object(id).(pdfStream)
+		if !ok {
+			continue
+		}
+		decoded, err := doc.decodeStream(stream)
+		if err != nil {
+			continue
+		}
+
+		n, _ := doc.resolve(stream.dict["N"]).(int64)
+		first, _ := doc.resolve(stream.dict["First"]).(int64)
+		header := &pdfParser{data: decoded}
+		for i := int64(0); i < n; i++ {
+			objID, err1 := header.parseObject(0)
+			objOffset, err2 := header.parseObject(0)
+			if err1 != nil || err2 != nil {
+				break
+			}
+			id, _ := objID.(int64)
+			offset, _ := objOffset.(int64)
+			if _, exists := doc.offsets[int(id)]; exists || first+offset >= int64(len(decoded)) {
+				continue
+			}
+
+			if obj, err := (&pdfParser{data: decoded, pos: int(first + offset)}).parseObject(0); err == nil {
+				doc.objects[int(id)] = obj
+			}
+		}
+	}
+
+	return doc
+}
+
+// parse an indirect object's body at given offset, and return it with the offset of its end
+func (doc *pdfDocument) parseIndirectObject(offset int) (interface{}, int, error) {
+	p := &pdfParser{data: doc.data, pos: offset}
+	obj, err := p.parseObject(0)
+	if err != nil {
+		return nil, offset, err
+	}
+
+	dict, isDict := obj.(pdfDict)
+	p.skipSpaces()
+	if !isDict || !bytes.HasPrefix(doc.data[p.pos:], []byte("stream")) {
+		return obj, p.pos, nil
+	}
+
+	// stream data begin after the EOL of `stream`, and span `/Length` bytes
+	start := p.pos + len("stream")
+	if bytes.HasPrefix(doc.data[start:], []byte("\r\n")) {
+		start += 2
+	} else if start < len(doc.data) && doc.data[start] == '\n' {
+		start++
+	}
+
+	var end int
+	if length, ok := doc.resolve(dict["Length"]).(int64); ok && length >= 0 && start+int(length) <= len(doc.data) &&
+		bytes.HasPrefix(bytes.TrimLeft(doc.data[start+int(length):], " \t\r\n"), []byte("endstream")) {
+		end = start + int(length)
+	} else if index := bytes.Index(doc.data[start:], []byte("endstream")); index >= 0 {
+		// (wrong or unresolvable lengths, eg. lengths defined after their streams while indexing)
+		end = start + index
+	} else {
+		return nil, offset, fmt.Errorf("unterminated stream at %d", offset)
+	}
+
+	return pdfStream{dict: dict, data: doc.data[start:end]}, end + len("endstream"), nil
+}
+
+// object of given id (nil if missing)
+func (doc *pdfDocument) object(id int) interface{} {
+	if obj, exists := doc.objects[id]; exists {
+		return obj
+	}
+
+	offset, exists := doc.offsets[id]
+	if !exists {
+		return nil
+	}
+
+	doc.objects[id] = nil // for not recursing infinitely
+	obj, _, err := doc.parseIndirectObject(offset)
+	if err != nil {
+		return nil
+	}
+	doc.objects[id] = obj
+
+	return obj
+}
+
+// resolve given value if it is a reference
+func (doc *pdfDocument) resolve(value interface{}) interface{} {
+	for i := 0; i < pdfMaxNesting; i++ {
+		ref, ok := value.(pdfRef)
+		if !ok {
+			return value
+		}
+		value = doc.object(ref.id)
+	}
+
+	return nil
+}
+
+// resolved dictionary value of given key (nil if missing or not a dictionary)
+func (doc *pdfDocument) dict(dict pdfDict, key pdfName) pdfDict {
+	if value, ok := doc.resolve(dict[key]).(pdfDict); ok {
+		return value
+	}
+	if stream, ok := doc.resolve(dict[key]).(pdfStream); ok {
+		return stream.dict
+	}
+
+	return nil
+}
+
+// names of filters of given stream
+func (doc *pdfDocument) filters(stream pdfStream) (filters []pdfName) {
+	switch filter := doc.resolve(stream.dict["Filter"]).(type) {
+	case pdfName:
+		filters = append(filters, filter)
+	case pdfArray:
+		for _, f := range filter {
+			if name, ok := doc.resolve(f).(pdfName); ok {
+				filters = append(filters, name)
+			}
+		}
+	}
+
+	return filters
+}
+
+// decode data of given stream (only flate-compressed ones without predictors are supported)
+func (doc *pdfDocument) decodeStream(stream pdfStream) ([]byte, error) {
+	filters := doc.filters(stream)
+	if len(filters) == 0 {
+		return stream.data, nil
+	}
+	if len(filters) > 1 || filters[0] != "FlateDecode" || stream.dict["DecodeParms"] != nil {
+		return nil, fmt.Errorf("unsupported filters: %v", filters)
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(stream.data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// read one more byte for checking if it exceeds the limit (for not being bombed by a small stream)
+	decoded, err := ioutil.ReadAll(io.LimitReader(reader, MaxPDFStreamBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > MaxPDFStreamBytes {
+		return nil, fmt.Errorf("decompressed stream too large (over %d bytes)", MaxPDFStreamBytes)
+	}
+
+	return decoded, nil
+}
+
+// dictionary of the first page with its (possibly inherited) resources, and the number of pages (0 if unknown)
+func (doc *pdfDocument) firstPage() (page, resources pdfDict, pages int) {
+	var catalog pdfDict
+	if matches := pdfRootRegexp.FindAllSubmatch(doc.data, -1); len(matches) > 0 {
+		id, _ := strconv.Atoi(string(matches[len(matches)-1][1]))
+		catalog, _ = doc.object(id).(pdfDict)
+	}
+	if catalog == nil {
+		// (no trailer, eg. broken documents)
+		ids := []int{}
+		for id := range doc.offsets {
+			ids = append(ids, id)
+		}
+		for id := range doc.objects {
+			ids = append(ids, id)
+		}
+		for _, id := range ids {
+			if dict, ok := doc.object(id).(pdfDict); ok && dict["Type"] == pdfName("Catalog") {
+				catalog = dict
+				break
+			}
+		}
+	}
+	if catalog == nil {
+		return nil, nil, 0
+	}
+
+	node := doc.dict(catalog, "Pages")
+	if count, ok := doc.resolve(node["Count"]).(int64); ok {
+		pages = int(count)
+	}
+
+	// descend to the first leaf of the page tree
+	for depth := 0; node != nil && depth < pdfMaxNesting; depth++ {
+		if res := doc.dict(node, "Resources"); res != nil {
+			resources = res
+		}
+		if node["Type"] == pdfName("Page") {
+			return node, resources, pages
+		}
+
+		kids, _ := doc.resolve(node["Kids"]).(pdfArray)
+		if len(kids) == 0 {
+			break
+		}
+		node, _ = doc.resolve(kids[0]).(pdfDict)
+	}
+
+	return nil, nil, pages
+}
+
+// image xobjects in given resources (including ones in form xobjects), larger ones first
+func (doc *pdfDocument) images(resources pdfDict, depth int) (images []pdfStream) {
+	if depth > 2 {
+		return nil
+	}
+
+	xobjects := doc.dict(resources, "XObject")
+	names := []string{}
+	for name := range xobjects {
+		names = append(names, string(name))
+	}
+	sort.Strings(names) // (for deterministic results)
+
+	for _, name := range names {
+		stream, ok := doc.resolve(xobjects[pdfName(name)]).(pdfStream)
+		if !ok {
+			continue
+		}
+
+		switch stream.dict["Subtype"] {
+		case pdfName("Image"):
+			// skip stencil masks
+			if mask, _ := doc.resolve(stream.dict["ImageMask"]).(bool); !mask {
+				images = append(images, stream)
+			}
+		case pdfName("Form"):
+			images = append(images, doc.images(doc.dict(stream.dict, "Resources"), depth+1)...)
+		}
+	}
+
+	area := func(s pdfStream) int64 {
+		w, _ := doc.resolve(s.dict["Width"]).(int64)
+		h, _ := doc.resolve(s.dict["Height"]).(int64)
+		return w * h
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		return area(images[i]) > area(images[j])
+	})
+
+	return images
+}
+
+// extract the image of the first page from given pdf bytes (with the number of pages, 0 if unknown)
+//
+// (pdf is not rasterized: the largest image drawn on the first page is used, so only scanned documents
+// with DCT(jpeg) or flate-compressed 8-bit gray/rgb images are supported)
+func firstPageImageOfPDF(pdfBytes []byte) (imgBytes []byte, pages int, err error) {
+	doc := newPDFDocument(pdfBytes)
+
+	page, resources, pages := doc.firstPage()
+	if page == nil {
+		return nil, pages, fmt.Errorf("no page in pdf")
+	}
+
+	for _, stream := range doc.images(resources, 0) {
+		switch filters := doc.filters(stream); {
+		case len(filters) == 1 && filters[0] == "DCTDecode":
+			return stream.data, pages, nil
+		case len(filters) == 0 || len(filters) == 1 && filters[0] == "FlateDecode":
+			var img image.Image
+			if img, err = doc.decodeFlateImage(stream); err != nil {
+				logMessage(fmt.Sprintf("Skipping unsupported image in pdf: %s", err))
+				continue
+			}
+
+			buf := new(bytes.Buffer)
+			if err = jpeg.Encode(buf, img, nil); err != nil {
+				return nil, pages, fmt.Errorf("failed to encode image in pdf: %s", err)
+			}
+
+			return buf.Bytes(), pages, nil
+		}
+	}
+
+	return nil, pages, errNoImageInPDF
+}
+
+// decode flate-compressed (or uncompressed) 8-bit gray/rgb image stream of a pdf
+func (doc *pdfDocument) decodeFlateImage(stream pdfStream) (image.Image, error) {
+	width, _ := doc.resolve(stream.dict["Width"]).(int64)
+	height, _ := doc.resolve(stream.dict["Height"]).(int64)
+	bits, _ := doc.resolve(stream.dict["BitsPerComponent"]).(int64)
+	if width <= 0 || height <= 0 || bits != 8 {
+		return nil, fmt.Errorf("unsupported image dimensions or bits per component")
+	}
+	if width > MaxPDFImagePixels || height > MaxPDFImagePixels || width*height > MaxPDFImagePixels {
+		return nil, fmt.Errorf("image too large (%dx%d)", width, height)
+	}
+
+	var channels int64
+	switch doc.resolve(stream.dict["ColorSpace"]) {
+	case pdfName("DeviceGray"):
+		channels = 1
+	case pdfName("DeviceRGB"):
+		channels = 3
+	default:
+		return nil, fmt.Errorf("unsupported color space")
+	}
+
+	decoded, err := doc.decodeStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) < width*height*channels {
+		return nil, fmt.Errorf("image data too short")
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+	for i := 0; i < int(width*height); i++ {
+		if channels == 1 {
+			img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2] = decoded[i], decoded[i], decoded[i]
+		} else {
+			img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2] = decoded[i*3], decoded[i*3+1], decoded[i*3+2]
+		}
+		img.Pix[i*4+3] = 255
+	}
+
+	return img, nil
+}
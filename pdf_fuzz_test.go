@@ -0,0 +1,24 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"testing"
+)
+
+func FuzzFirstPageImageOfPDF(f *testing.F) {
+	f.Add(twoPagesPDF(f, "[3 0 R 4 0 R]"))
+	f.Add(twoPagesPDF(f, "[4 0 R 3 0 R]"))
+	f.Add(objectStreamPDF(f))
+	f.Add(singlePagePDF(f, "<< >>"))
+	f.Add([]byte("%PDF-1.4\ntrailer << /Root 1 0 R >>"))
+
+	f.Fuzz(func(t *testing.T, pdf []byte) {
+		// should not panic nor hang, whatever the input is
+		imgBytes, _, err := firstPageImageOfPDF(pdf)
+		if err == nil && len(imgBytes) == 0 {
+			t.Errorf("no error, but no image extracted")
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+// jpeg bytes of an image filled with given color
+func solidJPEG(t testing.TB, width, height int, c color.Color) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatalf("failed to encode jpeg: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// zlib-compressed bytes of given data
+func deflated(t testing.TB, data []byte) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	writer := zlib.NewWriter(buf)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("failed to compress: %s", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to compress: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// indirect stream object with given dictionary entries (`/Length` is appended when `length` is empty)
+func pdfStreamObject(id int, entries, length string, data []byte) string {
+	if length == "" {
+		length = fmt.Sprintf("%d", len(data))
+	}
+	return fmt.Sprintf("%d 0 obj << %s /Length %s >>\nstream\n%s\nendstream\nendobj\n", id, entries, length, data)
+}
+
+// pdf document with a page of gray image (which includes "endstream" in its data) and a page of red jpeg image
+// (with a soft mask), whose objects are written in reversed order of pages
+func twoPagesPDF(t testing.TB, kids string) []byte {
+	gray := []byte(strings.Repeat("xendstreamx", 20)[:200])
+	red := solidJPEG(t, 64, 48, color.RGBA{255, 0, 0, 255})
+	mask := bytes.Repeat([]byte{0x80}, 64*48)
+
+	return []byte("%PDF-1.4\n" +
+		"1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n" +
+		"2 0 obj << /Type /Pages /Kids " + kids + " /Count 2 >> endobj\n" +
+		pdfStreamObject(5, "/Type /XObject /Subtype /Image /Width 20 /Height 10 /ColorSpace /DeviceGray /BitsPerComponent 8", "11 0 R", gray) +
+		"11 0 obj 200 endobj\n" +
+		pdfStreamObject(6, "/Type /XObject /Subtype /Image /Width 64 /Height 48 /ColorSpace /DeviceGray /BitsPerComponent 8", "", mask) +
+		pdfStreamObject(7, "/Type /XObject /Subtype /Image /Width 64 /Height 48 /ColorSpace /DeviceRGB /BitsPerComponent 8 /SMask 6 0 R /Filter /DCTDecode", "", red) +
+		"4 0 obj << /Type /Page /Parent 2 0 R /Resources << /XObject << /Im0 5 0 R >> >> >> endobj\n" +
+		"3 0 obj << /Type /Page /Parent 2 0 R /Resources << /XObject << /Im1 7 0 R >> >> >> endobj\n" +
+		"trailer << /Root 1 0 R >>\n%%EOF")
+}
+
+// pdf document whose catalog and pages are in a compressed object stream
+func objectStreamPDF(t testing.TB) []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 3 >>",
+		"<< /Type /Page /Parent 2 0 R /Resources << /XObject << /Im1 7 0 R >> >> >>",
+	}
+	header, body := "", ""
+	for i, object := range objects {
+		header += fmt.Sprintf("%d %d ", i+1, len(body))
+		body += object + "\n"
+	}
+
+	return []byte("%PDF-1.5\n" +
+		pdfStreamObject(10, fmt.Sprintf("/Type /ObjStm /N 3 /First %d /Filter /FlateDecode", len(header)), "", deflated(t, []byte(header+body))) +
+		pdfStreamObject(7, "/Type /XObject /Subtype /Image /Width 64 /Height 48 /Filter /DCTDecode", "", solidJPEG(t, 64, 48, color.RGBA{0, 0, 255, 255})) +
+		pdfStreamObject(12, "/Type /XRef /Root 1 0 R", "", nil) +
+		"%%EOF")
+}
+
+// pdf document with a page of given resources and contents
+func singlePagePDF(t testing.TB, resources string, objects ...string) []byte {
+	contents := []byte("BT /F1 24 Tf 72 720 Td (Hello) Tj ET")
+
+	return []byte("%PDF-1.4\n" +
+		"1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n" +
+		"2 0 obj << /Type /Pages /Kids [3 0 R] /Count 1 >> endobj\n" +
+		"3 0 obj << /Type /Page /Parent 2 0 R /Resources " + resources + " /Contents 4 0 R >> endobj\n" +
+		pdfStreamObject(4, "", "", contents) +
+		strings.Join(objects, "") +
+		"trailer << /Root 1 0 R >>\n%%EOF")
+}
+
+// decode given image bytes and return its size and color at the center
+func decodedImage(t *testing.T, imgBytes []byte) (image.Rectangle, color.RGBA) {
+	t.Helper()
+
+	img, _, err := image.Decode(bytes.NewReader(imgBytes))
+	if err != nil {
+		t.Fatalf("failed to decode extracted image: %s", err)
+	}
+	r, g, b, a := img.At(img.Bounds().Dx()/2, img.Bounds().Dy()/2).RGBA()
+
+	return img.Bounds(), color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+}
+
+func TestFirstPageImageOfPDF(t *testing.T) {
+	// image of the first page is used, not the first image in the file, nor its soft mask
+	imgBytes, pages, err := firstPageImageOfPDF(twoPagesPDF(t, "[3 0 R 4 0 R]"))
+	if err != nil {
+		t.Fatalf("failed to extract image: %s", err)
+	}
+	if pages != 2 {
+		t.Errorf("expected 2 pages, got %d", pages)
+	}
+	if bounds, c := decodedImage(t, imgBytes); bounds.Dx() != 64 || bounds.Dy() != 48 || c.R < 200 || c.G > 50 {
+		t.Errorf("expected the red image of the first page, got %v of %v", c, bounds)
+	}
+
+	// uncompressed gray image (with "endstream" in its data, and of indirect `/Length`)
+	imgBytes, _, err = firstPageImageOfPDF(twoPagesPDF(t, "[4 0 R 3 0 R]"))
+	if err != nil {
+		t.Fatalf("failed to extract image: %s", err)
+	}
+	if bounds, _ := decodedImage(t, imgBytes); bounds.Dx() != 20 || bounds.Dy() != 10 {
+		t.Errorf("expected the gray image of the first page, got %v", bounds)
+	}
+
+	// objects in a compressed object stream
+	imgBytes, pages, err = firstPageImageOfPDF(objectStreamPDF(t))
+	if err != nil {
+		t.Fatalf("failed to extract image: %s", err)
+	}
+	if pages != 3 {
+		t.Errorf("expected 3 pages, got %d", pages)
+	}
+	if _, c := decodedImage(t, imgBytes); c.B < 200 || c.R > 50 {
+		t.Errorf("expected the blue image, got %v", c)
+	}
+
+	// flate-compressed rgb image in a form xobject
+	rgb := bytes.Repeat([]byte{0, 255, 0}, 8*8)
+	imgBytes, _, err = firstPageImageOfPDF(singlePagePDF(t,
+		"<< /XObject << /Fm1 5 0 R >> >>",
+		pdfStreamObject(5, "/Type /XObject /Subtype /Form /Resources << /XObject << /Im1 6 0 R >> >>", "", nil),
+		pdfStreamObject(6, "/Type /XObject /Subtype /Image /Width 8 /Height 8 /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode", "", deflated(t, rgb)),
+	))
+	if err != nil {
+		t.Fatalf("failed to extract image: %s", err)
+	}
+	if _, c := decodedImage(t, imgBytes); c.G < 200 || c.R > 50 {
+		t.Errorf("expected the green image, got %v", c)
+	}
+}
+
+func TestFirstPageImageOfPDFWithoutImage(t *testing.T) {
+	for name, pdf := range map[string][]byte{
+		"text only": singlePagePDF(t, "<< /Font << /F1 << /Type /Font /Subtype /Type1 /BaseFont /Helvetica >> >> >>"),
+		"unsupported filter": singlePagePDF(t,
+			"<< /XObject << /Im1 5 0 R >> >>",
+			pdfStreamObject(5, "/Type /XObject /Subtype /Image /Width 8 /Height 8 /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /JBIG2Decode", "", []byte("jbig2")),
+		),
+		"too large": singlePagePDF(t,
+			"<< /XObject << /Im1 5 0 R >> >>",
+			pdfStreamObject(5, "/Type /XObject /Subtype /Image /Width 100000 /Height 100000 /ColorSpace /DeviceGray /BitsPerComponent 8", "", []byte("tiny")),
+		),
+		"decompression bomb": singlePagePDF(t,
+			"<< /XObject << /Im1 5 0 R >> >>",
+			pdfStreamObject(5, "/Type /XObject /Subtype /Image /Width 6000 /Height 6000 /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode", "", deflated(t, make([]byte, MaxPDFStreamBytes+1))),
+		),
+	} {
+		if _, _, err := firstPageImageOfPDF(pdf); err != errNoImageInPDF {
+			t.Errorf("%s: expected '%s', got %v", name, errNoImageInPDF, err)
+		}
+	}
+}
+
+func TestFirstPageImageOfMalformedPDF(t *testing.T) {
+	valid := twoPagesPDF(t, "[3 0 R 4 0 R]")
+
+	for name, pdf := range map[string][]byte{
+		"empty":         {},
+		"garbage":       []byte("%PDF-1.4\n\x00\xff garbage ]]>> obj endobj stream"),
+		"no pages":      []byte("%PDF-1.4\n1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n2 0 obj << /Type /Pages /Kids [] /Count 0 >> endobj\ntrailer << /Root 1 0 R >>"),
+		"cyclic pages":  []byte("%PDF-1.4\n1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n2 0 obj << /Type /Pages /Kids [2 0 R] /Count 1 >> endobj\ntrailer << /Root 1 0 R >>"),
+		"deep nesting":  []byte("%PDF-1.4\n1 0 obj " + strings.Repeat("[", 100000) + " endobj\ntrailer << /Root 1 0 R >>"),
+		"cyclic length": []byte("%PDF-1.4\n1 0 obj << /Length 1 0 R >>\nstream\nabc\nendstream\nendobj\ntrailer << /Root 1 0 R >>"),
+		"truncated":     valid[:len(valid)/2],
+	} {
+		if _, _, err := firstPageImageOfPDF(pdf); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}